@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/influxproxy/influxproxy/orchestrator"
 )
@@ -15,7 +16,11 @@ type Influxdb struct {
 }
 
 type Proxy struct {
-	Host string
+	Host            string
+	ShutdownTimeout time.Duration
+	InTimeout       time.Duration // timeout of plugin calls on /in, 0 keeps the timeout of the plugin
+	EchoTimeout     time.Duration // timeout of plugin calls on /echo, 0 keeps the timeout of the plugin
+	DescribeTimeout time.Duration // timeout of plugin descriptions, 0 keeps the timeout of the plugin
 }
 
 type Configuration struct {
@@ -29,13 +34,60 @@ func NewConfiguration(prefix string) *Configuration {
 		prefix = prefix + "_"
 	}
 
+	limits := orchestrator.LimitsConfiguration{
+		MaxMemory:    getUintEnv(prefix+"PLUGIN_MAXMEMORY", 0),
+		MaxCPU:       getDurationEnv(prefix+"PLUGIN_MAXCPU", 0),
+		MaxOpenFiles: getUintEnv(prefix+"PLUGIN_MAXOPENFILES", 0),
+		Nice:         getIntEnv(prefix+"PLUGIN_NICE", 0),
+		Uid:          uint32(getUintEnv(prefix+"PLUGIN_UID", 0)),
+		Gid:          uint32(getUintEnv(prefix+"PLUGIN_GID", 0)),
+	}
+
+	circuit := orchestrator.CircuitConfiguration{
+		Threshold:    getFloatEnv(prefix+"PLUGIN_CIRCUITTHRESHOLD", 0),
+		MinRequests:  getIntEnv(prefix+"PLUGIN_CIRCUITMINREQUESTS", 10),
+		Window:       getDurationEnv(prefix+"PLUGIN_CIRCUITWINDOW", 30*time.Second),
+		OpenDuration: getDurationEnv(prefix+"PLUGIN_CIRCUITOPEN", 30*time.Second),
+		Probes:       getIntEnv(prefix+"PLUGIN_CIRCUITPROBES", 1),
+	}
+
 	minport, _ := strconv.Atoi(os.Getenv(prefix + "PLUGIN_MINPORT"))
 	maxport, _ := strconv.Atoi(os.Getenv(prefix + "PLUGIN_MAXPORT"))
 
 	orch := &orchestrator.OrchestratorConfiguration{
-		PluginMinPort: minport,
-		PluginMaxPort: maxport,
-		Plugins:       strings.Split(os.Getenv(prefix+"PLUGINS"), " "),
+		PluginTransport:        os.Getenv(prefix + "PLUGIN_TRANSPORT"),
+		PluginMinPort:          minport,
+		PluginMaxPort:          maxport,
+		Plugins:                strings.Fields(os.Getenv(prefix + "PLUGINS")),
+		PluginConfigFile:       os.Getenv(prefix + "PLUGIN_CONFIG"),
+		PluginDir:              os.Getenv(prefix + "PLUGIN_DIR"),
+		PluginDirInterval:      getDurationEnv(prefix+"PLUGIN_DIRINTERVAL", 0),
+		PluginHandshakeTimeout: getDurationEnv(prefix+"PLUGIN_HANDSHAKETIMEOUT", 10*time.Second),
+		PluginMaxRestarts:      getIntEnv(prefix+"PLUGIN_MAXRESTARTS", 5),
+		PluginBackoffMin:       getDurationEnv(prefix+"PLUGIN_MINBACKOFF", time.Second),
+		PluginBackoffMax:       getDurationEnv(prefix+"PLUGIN_MAXBACKOFF", time.Minute),
+		PluginReplaceTimeout:   getDurationEnv(prefix+"PLUGIN_REPLACETIMEOUT", 30*time.Second),
+		PluginWatchInterval:    getDurationEnv(prefix+"PLUGIN_WATCHINTERVAL", 0),
+		PluginHealthInterval:   getDurationEnv(prefix+"PLUGIN_HEALTHINTERVAL", 10*time.Second),
+		PluginHealthTimeout:    getDurationEnv(prefix+"PLUGIN_HEALTHTIMEOUT", 2*time.Second),
+		PluginHealthThreshold:  getIntEnv(prefix+"PLUGIN_HEALTHTHRESHOLD", 3),
+		PluginReplicas:         getIntEnv(prefix+"PLUGIN_REPLICAS", 1),
+		PluginBalance:          os.Getenv(prefix + "PLUGIN_BALANCE"),
+		PluginStickyKey:        os.Getenv(prefix + "PLUGIN_STICKYKEY"),
+		PluginLogLines:         getIntEnv(prefix+"PLUGIN_LOGLINES", 1000),
+		PluginLogForward:       getBoolEnv(prefix+"PLUGIN_LOGFORWARD", false),
+		PluginLimits:           limits,
+		PluginEnv:              strings.Fields(os.Getenv(prefix + "PLUGIN_ENV")),
+		PluginCallTimeout:      getDurationEnv(prefix+"PLUGIN_CALLTIMEOUT", 30*time.Second),
+		PluginCircuit:          circuit,
+		PluginQueue: orchestrator.QueueConfiguration{
+			MaxInFlight: getIntEnv(prefix+"PLUGIN_MAXINFLIGHT", 0),
+			Length:      getIntEnv(prefix+"PLUGIN_QUEUELENGTH", 100),
+		},
+		PluginWasm: orchestrator.WasmConfiguration{
+			MaxMemory: getUintEnv(prefix+"PLUGIN_WASMMEMORY", 64<<20),
+			Fuel:      getUintEnv(prefix+"PLUGIN_WASMFUEL", 0),
+		},
 	}
 
 	db := &Influxdb{
@@ -45,7 +97,11 @@ func NewConfiguration(prefix string) *Configuration {
 	}
 
 	proxy := &Proxy{
-		Host: os.Getenv(prefix+"ADDRESS") + ":" + os.Getenv(prefix+"PORT"),
+		Host:            os.Getenv(prefix+"ADDRESS") + ":" + os.Getenv(prefix+"PORT"),
+		ShutdownTimeout: getDurationEnv(prefix+"SHUTDOWN_TIMEOUT", 30*time.Second),
+		InTimeout:       getDurationEnv(prefix+"IN_TIMEOUT", 0),
+		EchoTimeout:     getDurationEnv(prefix+"ECHO_TIMEOUT", 0),
+		DescribeTimeout: getDurationEnv(prefix+"DESCRIBE_TIMEOUT", 0),
 	}
 
 	config := &Configuration{
@@ -57,3 +113,53 @@ func NewConfiguration(prefix string) *Configuration {
 	return config
 
 }
+
+// getIntEnv returns the integer value of the given environment variable or the
+// default if the variable is not set or invalid.
+func getIntEnv(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getUintEnv returns the unsigned integer value of the given environment variable or
+// the default if the variable is not set or invalid.
+func getUintEnv(name string, def uint64) uint64 {
+	v, err := strconv.ParseUint(os.Getenv(name), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getFloatEnv returns the floating point value of the given environment variable or
+// the default if the variable is not set or invalid.
+func getFloatEnv(name string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getBoolEnv returns the boolean value (e.g. "true", "1") of the given environment
+// variable or the default if the variable is not set or invalid.
+func getBoolEnv(name string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getDurationEnv returns the duration (e.g. "1m30s") of the given environment
+// variable or the default if the variable is not set or invalid.
+func getDurationEnv(name string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
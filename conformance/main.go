@@ -0,0 +1,180 @@
+// Conformance checks that a plugin implements the protocol between the orchestrator
+// and its plugins as described in PROTOCOL.md. It is meant for plugins that are not
+// built on the 'plugin' package, e.g. plugins written in other languages than Go.
+//
+// The plugin is launched by an orchestrator just like influxproxy would launch it, and
+// then taken through the handshake, all RPC methods and the shutdown:
+//
+//	go run ./conformance [-transport unix] [-query 'k=v&k2=v2'] [-body file] /path/to/plugin [args...]
+//
+// Every check is reported on its own line. The exit code is 0 if all checks passed.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/influxproxy/influxproxy/orchestrator"
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// ---------------------------------------------------------------------------------
+// Checks
+// ---------------------------------------------------------------------------------
+
+// checker runs the checks and keeps track of their outcome.
+type checker struct {
+	failed bool
+}
+
+// check reports the outcome of a single check; err == nil means it passed.
+func (c *checker) check(name string, detail string, err error) bool {
+	if err != nil {
+		c.failed = true
+		fmt.Printf("FAIL  %-12s %s\n", name, err)
+		return false
+	}
+	fmt.Printf("PASS  %-12s %s\n", name, detail)
+	return true
+}
+
+// info reports a property of the plugin that is not checked.
+func (c *checker) info(name string, detail string) {
+	fmt.Printf("INFO  %-12s %s\n", name, detail)
+}
+
+// checkSeries checks that every point of every series has a value for each column.
+func checkSeries(reply *plugin.Response) error {
+	for _, s := range reply.Series {
+		if s == nil || s.Name == "" {
+			return errors.New("Series without name")
+		}
+		for _, p := range s.Points {
+			if len(p) != len(s.Columns) {
+				return fmt.Errorf("Series '%s' has a point with %d values for %d columns", s.Name, len(p), len(s.Columns))
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	transport := flag.String("transport", orchestrator.TransportTCP, "transport of the RPC connections: tcp or unix")
+	query := flag.String("query", "", "query string of the Run call")
+	bodyFile := flag.String("body", "", "file holding the body of the Run call")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of the handshake and of each call")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: conformance [flags] /path/to/plugin [args...]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	log.SetOutput(ioutil.Discard)
+
+	values, err := url.ParseQuery(*query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid query:", err)
+		os.Exit(2)
+	}
+	var body []byte
+	if *bodyFile != "" {
+		body, err = ioutil.ReadFile(*bodyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid body:", err)
+			os.Exit(2)
+		}
+	}
+
+	conf := &orchestrator.OrchestratorConfiguration{
+		PluginTransport:        *transport,
+		PluginMinPort:          20000,
+		PluginMaxPort:          29999,
+		PluginHandshakeTimeout: *timeout,
+		PluginHealthInterval:   time.Hour,
+		PluginCallTimeout:      *timeout,
+		PluginLogLines:         100,
+		PluginDefinitions: []orchestrator.PluginDefinition{
+			{Name: "conformance", Path: flag.Arg(0), Args: flag.Args()[1:]},
+		},
+	}
+	o, err := orchestrator.NewOrchestrator(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	c := &checker{}
+	defer func() {
+		if c.failed {
+			os.Exit(1)
+		}
+	}()
+
+	report, err := o.Start()
+	if err == nil && report.Plugins[0].Error != "" {
+		err = errors.New(report.Plugins[0].Error)
+	}
+	b := o.Registry.GetBrokerByName("conformance")
+	if !c.check("handshake", "completed", err) {
+		for _, l := range b.Logs().Lines() {
+			fmt.Printf("      %s: %s\n", l.Stream, l.Text)
+		}
+		o.Stop(context.Background())
+		return
+	}
+	s := b.Snapshot().Replicas[0]
+	c.check("protocol", fmt.Sprintf("version %d", s.Protocol), plugin.CheckProtocol(s.Protocol))
+	c.info("codec", s.Codec)
+	c.info("capabilities", strings.Join(s.Capabilities, ", "))
+
+	ctx := context.Background()
+	_, err = b.PingContext(ctx)
+	c.check("ping", "answered", err)
+
+	description, err := b.DescribeContext(ctx)
+	if err == nil && description.Description == "" {
+		err = errors.New("Description is empty")
+	}
+	if err == nil {
+		c.check("describe", description.Description, nil)
+	} else {
+		c.check("describe", "", err)
+	}
+
+	requests := []struct {
+		name    string
+		request plugin.Request
+	}{
+		{"run", plugin.Request{Query: values, Body: body}},
+		{"run-empty", plugin.Request{}},
+	}
+	for _, r := range requests {
+		reply, err := b.RunContext(ctx, r.request)
+		if err == nil {
+			err = checkSeries(reply)
+		}
+		if err == nil && reply.Error != "" {
+			c.check(r.name, fmt.Sprintf("plugin error '%s'", reply.Error), nil)
+		} else if err == nil {
+			c.check(r.name, fmt.Sprintf("%d series", len(reply.Series)), nil)
+		} else {
+			c.check(r.name, "", err)
+		}
+	}
+
+	stopCtx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	err = o.Stop(stopCtx)
+	if plugin.HasCapability(s.Capabilities, plugin.CapabilityShutdown) {
+		c.check("shutdown", "exited on request", err)
+	} else {
+		c.check("shutdown", "killed, plugin does not implement the shutdown capability", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/influxproxy/influxproxy/orchestrator"
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// mainEnv makes the test binary run the conformance tool instead of the tests, so
+// every run gets an orchestrator of its own.
+const mainEnv = "CONFORMANCE_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestSamplePlugin(t *testing.T) {
+	sample := filepath.Join(t.TempDir(), "sampleplugin")
+	out, err := exec.Command("go", "build", "-o", sample, "../orchestrator/testdata/sampleplugin").CombinedOutput()
+	if err != nil {
+		t.Skipf("Sample plugin could not be built: %s\n%s", err, out)
+	}
+
+	for _, transport := range []string{orchestrator.TransportTCP, orchestrator.TransportUnix} {
+		for _, codec := range []string{plugin.CodecGob, plugin.CodecJSON} {
+			t.Run(transport+"/"+codec, func(t *testing.T) {
+				cmd := exec.Command(os.Args[0], "-transport", transport, "-query", "fail=no+data", sample, "-codec", codec)
+				cmd.Env = append(os.Environ(), mainEnv+"=1")
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Fatalf("conformance checks failed: %s\n%s", err, out)
+				}
+				report := string(out)
+				for _, line := range []string{
+					"PASS  handshake",
+					"PASS  ping",
+					"PASS  describe     Sample plugin of the tests",
+					"PASS  run          plugin error 'no data'",
+					"PASS  run-empty    1 series",
+					"PASS  shutdown     exited on request",
+					"INFO  codec        " + codec,
+				} {
+					if !strings.Contains(report, line) {
+						t.Errorf("report lacks %q:\n%s", line, report)
+					}
+				}
+			})
+		}
+	}
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"math"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/influxproxy/influxproxy/orchestrator"
 	"github.com/influxproxy/influxproxy/plugin"
 )
 
-func handleGetPlugin(c *gin.Context, o *orchestrator.Orchestrator) (int, string) {
+func handleGetPlugin(c *gin.Context, o *orchestrator.Orchestrator, timeout time.Duration) (int, string) {
 	b := o.Registry.GetBrokerByName(c.Params.ByName("plugin"))
 	if b != nil {
-		reply, err := b.Describe()
+		if b.InMaintenance() {
+			return 503, b.Name + " is in maintenance mode and does not accept any data"
+		}
+
+		ctx, cancel := callContext(c, b, timeout)
+		defer cancel()
+		reply, err := b.DescribeContext(ctx)
 		if err != nil {
-			return 500, err.Error()
+			return callFailed(c, b, err)
 		}
 
 		text, err := json.Marshal(reply)
@@ -28,9 +39,13 @@ func handleGetPlugin(c *gin.Context, o *orchestrator.Orchestrator) (int, string)
 	}
 }
 
-func handleEchoPlugin(c *gin.Context, o *orchestrator.Orchestrator) (int, string) {
+func handleEchoPlugin(c *gin.Context, o *orchestrator.Orchestrator, timeout time.Duration) (int, string) {
 	b := o.Registry.GetBrokerByName(c.Params.ByName("plugin"))
 	if b != nil {
+		if b.InMaintenance() {
+			return 503, b.Name + " is in maintenance mode and does not accept any data"
+		}
+
 		body, err := ioutil.ReadAll(c.Request.Body)
 		if err != nil {
 			return 500, err.Error()
@@ -38,13 +53,16 @@ func handleEchoPlugin(c *gin.Context, o *orchestrator.Orchestrator) (int, string
 
 		query := c.Request.URL.Query()
 		call := plugin.Request{
-			Query: query,
-			Body:  body,
+			Query:  query,
+			Body:   body,
+			Header: orchestrator.CallHeader(c.Request.Header),
 		}
 
-		reply, err := b.Run(call)
+		ctx, cancel := callContext(c, b, timeout)
+		defer cancel()
+		reply, err := b.RunContext(ctx, call)
 		if err != nil {
-			return 500, err.Error()
+			return callFailed(c, b, err)
 		} else if reply.Error != "" {
 			return 500, reply.Error
 		}
@@ -60,14 +78,28 @@ func handleEchoPlugin(c *gin.Context, o *orchestrator.Orchestrator) (int, string
 	}
 }
 
-func handlePostPlugin(c *gin.Context, o *orchestrator.Orchestrator, influxdbs *Dbs) (int, string) {
+func handlePostPlugin(c *gin.Context, o *orchestrator.Orchestrator, influxdbs *Dbs, timeout time.Duration) (int, string) {
 	b := o.Registry.GetBrokerByName(c.Params.ByName("plugin"))
 	if b != nil {
+		if b.InMaintenance() {
+			return 503, b.Name + " is in maintenance mode and does not accept any data"
+		}
+
 		db, err := influxdbs.Get(c.Params.ByName("db"))
 		if err != nil {
 			return 500, err.Error()
 		}
 
+		// wait for the plugin before buffering the body, shed load if it is too busy; the
+		// timeout covers the wait and the call
+		ctx, cancel := callContext(c, b, timeout)
+		defer cancel()
+		slot, err := b.Acquire(ctx)
+		if err != nil {
+			return callFailed(c, b, err)
+		}
+		defer slot.Release()
+
 		body, err := ioutil.ReadAll(c.Request.Body)
 		if err != nil {
 			return 500, err.Error()
@@ -76,13 +108,14 @@ func handlePostPlugin(c *gin.Context, o *orchestrator.Orchestrator, influxdbs *D
 		query := c.Request.URL.Query()
 
 		call := plugin.Request{
-			Query: query,
-			Body:  body,
+			Query:  query,
+			Body:   body,
+			Header: orchestrator.CallHeader(c.Request.Header),
 		}
 
-		reply, err := b.Run(call)
+		reply, err := slot.Run(ctx, call)
 		if err != nil {
-			return 500, err.Error()
+			return callFailed(c, b, err)
 		} else if reply.Error != "" {
 			return 500, reply.Error
 		}
@@ -98,6 +131,67 @@ func handlePostPlugin(c *gin.Context, o *orchestrator.Orchestrator, influxdbs *D
 	}
 }
 
+// callContext returns the context of a plugin call on behalf of the request. The call
+// is cancelled as soon as the client disconnects. A timeout > 0 overrides the call
+// timeout of the plugin; either way the deadline is set here, so it is shared by all
+// steps of the call.
+func callContext(c *gin.Context, b *orchestrator.PluginBroker, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(c.Request.Context(), timeout)
+	}
+	return b.WithTimeout(c.Request.Context())
+}
+
+// callFailed returns the HTTP status code and message of a failed plugin call. While
+// the circuit of the plugin is open, the client is told when to retry.
+func callFailed(c *gin.Context, b *orchestrator.PluginBroker, err error) (int, string) {
+	switch err {
+	case orchestrator.ErrStopping:
+		return 503, err.Error()
+	case orchestrator.ErrCircuitOpen:
+		retry := int(math.Ceil(b.RetryAfter().Seconds()))
+		if retry < 1 {
+			retry = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(retry))
+		return 503, err.Error()
+	case orchestrator.ErrQueueFull:
+		return 429, err.Error()
+	case orchestrator.ErrTimeout:
+		return 504, err.Error()
+	case context.Canceled:
+		return 499, err.Error() // client closed the request, nobody reads the response anyway
+	default:
+		return 500, err.Error()
+	}
+}
+
+func handlePostPlugins(c *gin.Context, o *orchestrator.Orchestrator) (int, string) {
+	var def orchestrator.PluginDefinition
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return 500, err.Error()
+	}
+	err = json.Unmarshal(body, &def)
+	if err != nil || (def.Path == "" && def.URL == "") {
+		return 400, "Request body needs to be a JSON object with the path of the plugin binary (or the url of an http plugin) and optionally its name, kind, args, env and dir, e.g. {\"path\": \"/opt/plugins/myplugin\"}"
+	}
+
+	b, err := o.AddPlugin(def)
+	if b == nil {
+		return 400, err.Error()
+	}
+
+	text, jsonErr := json.Marshal(b)
+	if jsonErr != nil {
+		return 500, jsonErr.Error()
+	} else if err != nil {
+		return 502, string(text)
+	} else {
+		return 201, string(text)
+	}
+}
+
 func handleGetBrokers(c *gin.Context, o *orchestrator.Orchestrator) (int, string) {
 	b, err := json.Marshal(o.Registry)
 	if err == nil {
@@ -107,6 +201,92 @@ func handleGetBrokers(c *gin.Context, o *orchestrator.Orchestrator) (int, string
 	}
 }
 
+func handleDeleteBroker(c *gin.Context, o *orchestrator.Orchestrator, conf *Configuration) (int, string) {
+	name := c.Params.ByName("name")
+	if o.Registry.GetBrokerByName(name) == nil {
+		return 404, name + " does not exist"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Proxy.ShutdownTimeout)
+	defer cancel()
+	err := o.RemovePlugin(ctx, name)
+	if err != nil {
+		return 500, err.Error()
+	} else {
+		return 200, name + " is stopped and unregistered"
+	}
+}
+
+func handleReplaceBroker(c *gin.Context, o *orchestrator.Orchestrator) (int, string) {
+	name := c.Params.ByName("name")
+	if o.Registry.GetBrokerByName(name) == nil {
+		return 404, name + " does not exist"
+	}
+
+	err := o.ReplacePlugin(name)
+	if err != nil {
+		return 500, err.Error()
+	} else {
+		return 200, name + " is replaced"
+	}
+}
+
+func handleMaintenance(c *gin.Context, o *orchestrator.Orchestrator, enabled bool) (int, string) {
+	b := o.Registry.GetBrokerByName(c.Params.ByName("name"))
+	if b != nil {
+		b.SetMaintenance(enabled)
+		if enabled {
+			return 200, b.Name + " is in maintenance mode"
+		} else {
+			return 200, b.Name + " is back in service"
+		}
+	} else {
+		return 404, c.Params.ByName("name") + " does not exist"
+	}
+}
+
+// handleGetBrokerLogs writes the buffered output of the plugin processes as JSON. With
+// ?follow=true, the output is streamed as one JSON object per line until the client
+// disconnects or the server shuts down.
+func handleGetBrokerLogs(c *gin.Context, o *orchestrator.Orchestrator, shutdown <-chan struct{}) {
+	b := o.Registry.GetBrokerByName(c.Params.ByName("name"))
+	if b == nil {
+		c.String(404, c.Params.ByName("name")+" does not exist")
+		return
+	}
+
+	follow, _ := strconv.ParseBool(c.Request.URL.Query().Get("follow"))
+	if !follow {
+		text, err := json.Marshal(b.Logs().Lines())
+		if err != nil {
+			c.String(500, err.Error())
+		} else {
+			c.String(200, string(text))
+		}
+		return
+	}
+
+	lines, f, unfollow := b.Logs().Follow()
+	defer unfollow()
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(200)
+	enc := json.NewEncoder(c.Writer)
+	for _, line := range lines {
+		enc.Encode(line)
+	}
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case line := <-f:
+			return enc.Encode(line) == nil
+		case <-c.Request.Context().Done():
+			return false
+		case <-shutdown:
+			return false
+		}
+	})
+}
+
 func handleGetConfig(c *gin.Context, conf *Configuration) (int, string) {
 	b, err := json.Marshal(conf)
 	if err == nil {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/influxproxy/influxproxy/orchestrator"
+)
+
+func TestMaintenanceRefusesRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	o := &orchestrator.Orchestrator{Registry: orchestrator.NewBrokerRegistry()}
+	b, err := o.Registry.RegisterBroker(
+		orchestrator.PluginDefinition{Name: "down", Kind: orchestrator.KindHTTP, URL: "http://127.0.0.1:1/"},
+		orchestrator.BrokerConfiguration{Kind: orchestrator.KindHTTP},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetMaintenance(true)
+
+	g := gin.New()
+	g.GET("/in/:db/:plugin", func(c *gin.Context) {
+		c.String(handleGetPlugin(c, o, 0))
+	})
+	g.POST("/in/:db/:plugin", func(c *gin.Context) {
+		c.String(handlePostPlugin(c, o, nil, 0))
+	})
+	g.POST("/echo/:plugin", func(c *gin.Context) {
+		c.String(handleEchoPlugin(c, o, 0))
+	})
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/in/metrics/down"},
+		{"POST", "/in/metrics/down"},
+		{"POST", "/echo/down"},
+	} {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(req.method, req.path, strings.NewReader("1\n")))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s in maintenance mode = %d %q, want 503", req.method, req.path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	r := orchestrator.NewBrokerRegistry()
+	b, err := r.RegisterBroker(
+		orchestrator.PluginDefinition{Name: "slow", Kind: orchestrator.KindHTTP, URL: "http://127.0.0.1:1/"},
+		orchestrator.BrokerConfiguration{Kind: orchestrator.KindHTTP, CallTimeout: time.Hour},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/in/metrics/slow", nil)
+
+	for _, tt := range []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{0, time.Hour}, // the call timeout of the plugin
+		{time.Minute, time.Minute},
+	} {
+		ctx, cancel := callContext(c, b, tt.timeout)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok {
+			t.Errorf("callContext() with timeout %s has no deadline", tt.timeout)
+			continue
+		}
+		// Acquire and Slot.Run keep an existing deadline instead of starting their own
+		acquired, cancel := b.WithTimeout(ctx)
+		if d, _ := acquired.Deadline(); !d.Equal(deadline) {
+			t.Errorf("deadline of the call moved from %s to %s", deadline, d)
+		}
+		cancel()
+		if left := time.Until(deadline); left > tt.want || left < tt.want-time.Minute/2 {
+			t.Errorf("callContext() with timeout %s leaves %s, want %s", tt.timeout, left, tt.want)
+		}
+	}
+}
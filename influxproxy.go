@@ -1,40 +1,57 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/influxproxy/influxproxy/orchestrator"
 )
 
 func main() {
+	// the processes of plugins with limits start as a copy of the proxy, see ShimMain
+	orchestrator.ShimMain()
+
 	conf := NewConfiguration("INFLUXPROXY")
 
 	influxdbs := NewDbs(conf.Influxdb)
 
+	// plugins that cannot be registered are logged, the others are served anyway
 	o, err := orchestrator.NewOrchestrator(conf.Orchestrator)
-	if err != nil {
+	if o == nil {
 		log.Panic(err)
 	}
 
-	messages, err := o.Start()
-	for _, message := range messages {
-		log.Println(message)
-	}
+	report, err := o.Start()
 	if err != nil {
 		log.Panic(err)
 	}
+	log.Printf("Orchestrator started on %s", report.Address)
+	for _, p := range report.Plugins {
+		if p.Error != "" {
+			log.Printf("Plugin %s could not be loaded after %s: %s", p.Name, p.Duration, p.Error)
+		} else {
+			log.Printf("Plugin %s loaded in %s", p.Name, p.Duration)
+		}
+	}
+
+	// closed as soon as the server shuts down, ends streaming responses
+	shutdown := make(chan struct{})
 
 	g := gin.Default()
 
 	in := g.Group("/in")
 	{
 		in.GET("/:db/:plugin", func(c *gin.Context) {
-			c.String(handleGetPlugin(c, o))
+			c.String(handleGetPlugin(c, o, conf.Proxy.DescribeTimeout))
 		})
 
 		in.POST("/:db/:plugin", func(c *gin.Context) {
-			c.String(handlePostPlugin(c, o, influxdbs))
+			c.String(handlePostPlugin(c, o, influxdbs, conf.Proxy.InTimeout))
 		})
 	}
 
@@ -44,17 +61,72 @@ func main() {
 			c.String(handleGetBrokers(c, o))
 		})
 
+		admin.GET("/brokers/:name/logs", func(c *gin.Context) {
+			handleGetBrokerLogs(c, o, shutdown)
+		})
+
+		admin.DELETE("/brokers/:name", func(c *gin.Context) {
+			c.String(handleDeleteBroker(c, o, conf))
+		})
+
+		admin.POST("/brokers/:name/replace", func(c *gin.Context) {
+			c.String(handleReplaceBroker(c, o))
+		})
+
+		admin.POST("/brokers/:name/maintenance", func(c *gin.Context) {
+			c.String(handleMaintenance(c, o, true))
+		})
+
+		admin.DELETE("/brokers/:name/maintenance", func(c *gin.Context) {
+			c.String(handleMaintenance(c, o, false))
+		})
+
 		admin.GET("/config", func(c *gin.Context) {
 			c.String(handleGetConfig(c, conf))
 		})
+
+		admin.POST("/plugins", func(c *gin.Context) {
+			c.String(handlePostPlugins(c, o))
+		})
 	}
 
 	echo := g.Group("/echo")
 	{
 		echo.POST("/:plugin", func(c *gin.Context) {
-			c.String(handleEchoPlugin(c, o))
+			c.String(handleEchoPlugin(c, o, conf.Proxy.EchoTimeout))
 		})
 	}
 
-	g.Run(conf.Proxy.Host)
+	server := &http.Server{
+		Addr:    conf.Proxy.Host,
+		Handler: g,
+	}
+	server.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Panic(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("Received " + (<-sig).String() + ", shutting down")
+
+	// Stop accepting requests first, then drain and stop the plugins. Plugins that
+	// miss the deadline are killed.
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Proxy.ShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	err = o.Stop(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	log.Println("Shutdown complete")
 }
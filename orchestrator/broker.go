@@ -1,60 +1,220 @@
 package orchestrator
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"net/rpc"
-	"os"
-	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/influxproxy/influxproxy/plugin"
 )
 
+// ErrStopping is returned by a broker that does not accept any calls anymore, since
+// its plugin is being stopped.
+var ErrStopping = errors.New("Plugin is stopping")
+
+// ErrTimeout is returned if a plugin did not answer a call before its deadline.
+var ErrTimeout = errors.New("Plugin call timed out")
+
+// errNotConnected is returned if no connected plugin process is available.
+var errNotConnected = errors.New("Plugin not connected")
+
+// maxRetries is the number of times a failed Run call is retried on another replica.
+// A request that crashes the plugin would otherwise take down one replica after the
+// other.
+const maxRetries = 1
+
 // ---------------------------------------------------------------------------------
 // PluginBroker
 // ---------------------------------------------------------------------------------
 
 // PluginBroker holds information about the plugin itself, its state
-// The broker also manages the life cycle of the plugin.
+// The broker also manages the life cycle of the plugin. A plugin can run several
+// processes (replicas) that share the same name; the broker dispatches the calls
+// among them.
+//
+// The exported fields do not change after the broker was created. The status of the
+// broker and its replicas changes concurrently; it is read via Snapshot.
 type PluginBroker struct {
-	Name      string        // name of the plugin
-	Plugin    string        // file system path of the plugin
-	Port      int           // port of the RPC server of the plugin
-	readyChan chan bool     // channel that is used in order to get the connected state from the connector
-	client    *rpc.Client   // RPC client used to access the functionality of the plugin
-	Status    *PluginStatus // status of the plugin
+	Name        string              // name of the plugin
+	Kind        string              // kind of the plugin, KindPlugin if empty
+	Plugin      string              // file system path of the plugin, URL of KindHTTP
+	Args        []string            // command-line arguments of the plugin
+	Dir         string              // working directory of the plugin
+	Balance     string              // strategy used to dispatch Run calls among the replicas
+	StickyKey   string              // query parameter that routes related requests to the same replica
+	Replicas    []*Replica          // processes of the plugin, none for kinds other than KindPlugin
+	runner      runner              // serves the calls of kinds other than KindPlugin
+	next        uint32              // round robin counter
+	mu          sync.Mutex          // guards the instances of the replicas, stopping and the registration of in-flight calls
+	stopping    bool                // set as soon as the plugin is being stopped
+	logs        *LogBuffer          // latest output of the processes of the plugin
+	circuit     *circuit            // circuit breaker of the Run calls
+	queue       *callQueue          // bounds the Run calls in-flight
+	config      BrokerConfiguration // configuration the processes of the plugin are run with
+	statusMu    sync.RWMutex        // guards maintenance and the status of the broker and its replicas, acquired after mu
+	maintenance bool                // set if the plugin is taken out of service while it keeps running
+	status      PluginStatus        // status of the plugin, aggregated over all replicas
 }
 
 // NewPluginBroker return an initialized plugin broker of a not yet started plugin.
-func NewPluginBroker(name string, plugin string) (*PluginBroker, error) {
-	s := &PluginStatus{
-		State:     None,
-		FailCount: 0,
-		RunCount:  0,
+func NewPluginBroker(name string, plugin string, conf BrokerConfiguration) (*PluginBroker, error) {
+	pool := &conf.Pool
+	if pool.Balance == "" {
+		pool.Balance = RoundRobin
+	}
+	if pool.Balance != RoundRobin && pool.Balance != LeastInFlight {
+		return nil, errors.New("Unknown balance strategy '" + pool.Balance + "' for plugin '" + name + "'. ")
+	}
+	if pool.Replicas < 1 {
+		pool.Replicas = 1
+	}
+	if conf.Kind == "" {
+		conf.Kind = KindPlugin
 	}
 
-	c := make(chan bool)
+	s := PluginStatus{
+		State:        None,
+		FailCount:    0,
+		RunCount:     0,
+		RestartCount: 0,
+		ReplaceCount: 0,
+	}
 
 	b := &PluginBroker{
 		Name:      name,
+		Kind:      conf.Kind,
 		Plugin:    plugin,
-		Port:      0,
-		readyChan: c,
-		client:    nil,
-		Status:    s,
+		Balance:   pool.Balance,
+		StickyKey: pool.StickyKey,
+		logs:      NewLogBuffer(conf.Logs.Lines),
+		circuit:   newCircuit(conf.Circuit),
+		queue:     newCallQueue(conf.Queue),
+		config:    conf,
+		status:    s,
+	}
+	var err error
+	b.runner, err = newRunner(b, conf.Kind)
+	if err != nil {
+		return nil, err
+	}
+	if b.runner == nil {
+		for i := 0; i < pool.Replicas; i++ {
+			b.Replicas = append(b.Replicas, newReplica(b, i))
+		}
 	}
 
 	return b, nil
 }
 
-// Maintains the start process of a plugin.
+// Snapshot returns a consistent copy of the state of the broker and its replicas.
+func (b *PluginBroker) Snapshot() BrokerSnapshot {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+	s := BrokerSnapshot{
+		Name:        b.Name,
+		Kind:        b.Kind,
+		Plugin:      b.Plugin,
+		Args:        b.Args,
+		Dir:         b.Dir,
+		Maintenance: b.maintenance,
+		Balance:     b.Balance,
+		StickyKey:   b.StickyKey,
+		Replicas:    make([]ReplicaSnapshot, len(b.Replicas)),
+		Status:      b.status,
+		Circuit:     b.circuit.snapshot(),
+		Queue:       b.queue.snapshot(),
+	}
+	for i, r := range b.Replicas {
+		s.Replicas[i] = r.snapshot()
+	}
+	return s
+}
+
+// MarshalJSON implements the json.Marshaler interface by marshaling a snapshot of the
+// broker.
+func (b *PluginBroker) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.Snapshot())
+}
+
+// RetryAfter returns the time until the circuit breaker of the plugin lets calls pass
+// again, 0 if it is not open.
+func (b *PluginBroker) RetryAfter() time.Duration {
+	return b.circuit.retryAfter()
+}
+
+// State returns the current state of the plugin, aggregated over all replicas.
+func (b *PluginBroker) State() State {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+	return b.status.State
+}
+
+// InMaintenance reports whether the plugin is taken out of service.
+func (b *PluginBroker) InMaintenance() bool {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+	return b.maintenance
+}
+
+// SetMaintenance takes the plugin out of service or puts it back in service. The
+// processes of the plugin keep running either way.
+func (b *PluginBroker) SetMaintenance(enabled bool) {
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+	b.maintenance = enabled
+}
+
+// Logs returns the buffer holding the latest output of the processes of the plugin.
+func (b *PluginBroker) Logs() *LogBuffer {
+	return b.logs
+}
+
+// Spinup starts all replicas of the plugin concurrently. It returns as soon as each
+// of them is connected or failed to connect. Plugins without replicas only check that
+// they are able to serve calls.
 func (b *PluginBroker) Spinup(orch *Orchestrator) error {
-	c := make(chan error)
-	go b.launch(c, orch)
-	err := <-c
-	<-b.readyChan
+	if b.runner != nil {
+		return b.startRunner()
+	}
+	errs := make([]error, len(b.Replicas))
+	var wg sync.WaitGroup
+	for i, r := range b.Replicas {
+		wg.Add(1)
+		go func(i int, r *Replica) {
+			defer wg.Done()
+			errs[i] = r.Spinup(orch)
+		}(i, r)
+	}
+	wg.Wait()
+	return b.collect(errs)
+}
 
-	if err != nil {
-		return err
+// Replace replaces the processes of all connected replicas one after another, so the
+// plugin keeps serving during the whole replacement. See Replica.Replace.
+func (b *PluginBroker) Replace(ctx context.Context, orch *Orchestrator) error {
+	if b.isStopping() {
+		return ErrStopping
+	}
+
+	replaced := false
+	for _, r := range b.Replicas {
+		if !r.state().IsConnected() {
+			continue
+		}
+		err := r.Replace(ctx, orch)
+		if err != nil {
+			return err
+		}
+		replaced = true
+	}
+	if !replaced {
+		return errNotConnected
 	}
 	return nil
 }
@@ -62,12 +222,27 @@ func (b *PluginBroker) Spinup(orch *Orchestrator) error {
 // Ping calles the plugin. Its only purpose is to ensure that the plugin is alive
 // and responding.
 func (b *PluginBroker) Ping() (bool, error) {
-	if b.Status.State != Connected {
-		return false, errors.New("Plugin not connected")
+	return b.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but gives up as soon as the context is done. Contexts
+// without a deadline get the call timeout of the plugin.
+func (b *PluginBroker) PingContext(ctx context.Context) (bool, error) {
+	ctx, cancel := b.WithTimeout(ctx)
+	defer cancel()
+	if b.runner != nil {
+		return b.runner.ping(ctx)
 	}
+	r, err := b.pick(nil, nil)
+	if err != nil {
+		return false, err
+	}
+
 	var reply bool
-	call := new([]interface{})
-	err := b.client.Call("Connector.Ping", *call, &reply)
+	err = r.call(ctx, "Connector.Ping", func(c pluginClient) (err error) {
+		reply, err = c.Ping(ctx)
+		return err
+	})
 	if err != nil {
 		return false, err
 	}
@@ -78,91 +253,323 @@ func (b *PluginBroker) Ping() (bool, error) {
 // The returned plugin.Description provides detailed information on the
 // funtionality and the arguments of the plugin.
 func (b *PluginBroker) Describe() (*plugin.Description, error) {
-	if b.Status.State != Connected {
-		return nil, errors.New("Plugin not connected")
+	return b.DescribeContext(context.Background())
+}
+
+// DescribeContext is like Describe, but gives up as soon as the context is done.
+// Contexts without a deadline get the call timeout of the plugin.
+func (b *PluginBroker) DescribeContext(ctx context.Context) (*plugin.Description, error) {
+	ctx, cancel := b.WithTimeout(ctx)
+	defer cancel()
+	if b.runner != nil {
+		return b.runner.describe(ctx)
 	}
+	r, err := b.pick(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	var reply *plugin.Description
-	call := new([]interface{})
-	err := b.client.Call("Connector.Describe", *call, &reply)
+	err = r.call(ctx, "Connector.Describe", func(c pluginClient) (err error) {
+		reply, err = c.Describe(ctx)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return reply, nil
 }
 
-// Run invoces the main functionality of the plugin.
+// Run invoces the main functionality of the plugin. If the chosen replica dies during
+// the call, the call is retried on another replica.
 func (b *PluginBroker) Run(data plugin.Request) (*plugin.Response, error) {
+	return b.RunContext(context.Background(), data)
+}
+
+// RunContext is like Run, but gives up as soon as the context is done; ErrTimeout is
+// returned if its deadline passed. Contexts without a deadline get the call timeout
+// of the plugin, which includes the time waiting for a slot (see Acquire). Calls that
+// timed out or were cancelled are not retried. While the circuit breaker of the plugin
+// is open, ErrCircuitOpen is returned right away.
+//
+// Plugins speaking gob or jsonrpc cannot be told to give up on a call, so they keep
+// running it after RunContext returned. Such an abandoned call counts as in-flight on
+// its replica and keeps its slot until the plugin answered; the answer is discarded.
+// Calls over grpc are cancelled instead.
+func (b *PluginBroker) RunContext(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	ctx, cancel := b.WithTimeout(ctx)
+	defer cancel()
+	s, err := b.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Run(ctx, data)
+}
+
+// run dispatches a Run call to a replica and retries it once on another replica if the
+// error is retryable. Plugins without replicas hand the call to their runner.
+func (b *PluginBroker) run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	if b.runner != nil {
+		return b.runner.run(ctx, data)
+	}
 	var reply *plugin.Response
-	if b.Status.State != Connected {
-		return reply, errors.New("Plugin not connected")
+	var err error
+	tried := make([]bool, len(b.Replicas))
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		r, pickErr := b.pick(&data, tried)
+		if pickErr != nil {
+			if err == nil {
+				err = pickErr
+			}
+			return nil, err
+		}
+		tried[r.Index] = true
+
+		reply, err = r.run(ctx, data)
+		if err == nil || !isRetryable(err) {
+			return reply, err
+		}
+	}
+	return nil, err
+}
+
+// Stop shuts the plugin down gracefully: new calls are refused, in-flight calls are
+// awaited and the plugin is asked to exit via its Shutdown RPC. If the plugin did not
+// exit when the context is done, its process is killed.
+func (b *PluginBroker) Stop(ctx context.Context) error {
+	b.mu.Lock()
+	b.stopping = true
+	b.mu.Unlock()
+
+	if b.runner != nil {
+		err := b.stopRunner(ctx)
+		if err != nil {
+			return errors.New("Plugin " + b.Name + " killed: " + err.Error())
+		}
+		return nil
 	}
+	errs := make([]error, len(b.Replicas))
+	var wg sync.WaitGroup
+	for i, r := range b.Replicas {
+		wg.Add(1)
+		go func(i int, r *Replica) {
+			defer wg.Done()
+			errs[i] = r.Stop(ctx)
+		}(i, r)
+	}
+	wg.Wait()
 
-	err := b.client.Call("Connector.Run", data, &reply)
+	err := b.collect(errs)
 	if err != nil {
-		return reply, err
+		return errors.New("Plugin " + b.Name + " killed: " + err.Error())
 	}
-	b.Status.RunCount += 1
-	return reply, nil
+	return nil
 }
 
-// launch starts the plugin binary with its configuration as environment and runs for
-// the whole life of the plugin. It also initiates the cleanup if the plugin panics or
-// fails for any reason.
-func (b *PluginBroker) launch(c chan error, orch *Orchestrator) {
-	if _, err := os.Stat(b.Plugin); os.IsNotExist(err) {
-		b.fail(c, err)
-		return
+// pick selects the replica for a call. Requests that carry the sticky key go to the
+// replica the value of the key hashes to, as long as it is connected. All other calls
+// are dispatched according to the balance strategy. Replicas that were already tried
+// are skipped.
+func (b *PluginBroker) pick(data *plugin.Request, tried []bool) (*Replica, error) {
+	var candidates []*Replica
+	for _, r := range b.Replicas {
+		if (tried == nil || !tried[r.Index]) && r.state().IsConnected() {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errNotConnected
 	}
 
-	cmd := exec.Command(b.Plugin)
-	cmd.Env = append(cmd.Env, orch.getEnv()...)
-	err := cmd.Start()
-	if err != nil {
-		b.fail(c, err)
-		return
+	if b.StickyKey != "" && data != nil {
+		if key := data.Query.Get(b.StickyKey); key != "" {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			r := b.Replicas[h.Sum32()%uint32(len(b.Replicas))]
+			for _, c := range candidates {
+				if c == r {
+					return r, nil
+				}
+			}
+		}
 	}
 
-	b.Status.State = Started
+	switch b.Balance {
+	case LeastInFlight:
+		best := candidates[0]
+		for _, c := range candidates[1:] {
+			if c.inFlight() < best.inFlight() {
+				best = c
+			}
+		}
+		return best, nil
+	default:
+		n := atomic.AddUint32(&b.next, 1)
+		return candidates[n%uint32(len(candidates))], nil
+	}
+}
 
-	defer b.cleanup(c, err, cmd)
+// lookup finds the replica and the instance of the plugin process that was given the
+// plugin token.
+func (b *PluginBroker) lookup(token string) (*Replica, *instance) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.Replicas {
+		if inst := r.lookup(token); inst != nil {
+			return r, inst
+		}
+	}
+	return nil, nil
+}
 
-	exitCh := make(chan struct{})
-	go b.watch(c, cmd, exitCh)
+// outdated reports whether any connected replica runs a binary with a checksum other
+// than the given one.
+func (b *PluginBroker) outdated(checksum string) bool {
+	for _, r := range b.Replicas {
+		if r.state().IsConnected() && r.checksum() != checksum {
+			return true
+		}
+	}
+	return false
 }
 
-// fail makes shure that the state of the plugin is reset and channels are unblocked.
-func (b *PluginBroker) fail(c chan error, err error) {
-	b.reset()
-	b.Status.FailCount += 1
-	c <- err
-	b.readyChan <- false
+// WithTimeout applies the call timeout of the plugin to contexts without a deadline.
+// Callers that acquire a slot themselves pass the context to both Acquire and Slot.Run,
+// so that the timeout includes the time spent in the queue like with RunContext.
+func (b *PluginBroker) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || b.config.CallTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.config.CallTimeout)
 }
 
-// watch keeps track of the plugin and cleans up if the plugin dies for any reason.
-func (b *PluginBroker) watch(c chan error, cmd *exec.Cmd, exitCh chan struct{}) {
-	cmd.Wait()
-	err := errors.New("Plugin ended")
-	b.fail(c, err)
-	close(exitCh)
+// isStopping reports whether the plugin is being stopped.
+func (b *PluginBroker) isStopping() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stopping
 }
 
-// cleanup makes shure that any plugin process is cleaned up.
-func (b *PluginBroker) cleanup(c chan error, err error, cmd *exec.Cmd) {
-	c <- nil
-	r := recover()
-	if err != nil || r != nil {
-		cmd.Process.Kill()
+// refresh aggregates the status of the replicas into the status of the broker. The
+// broker is in the most available state of any of its replicas. The status lock needs
+// to be held by the caller.
+func (b *PluginBroker) refresh() {
+	s := &b.status
+	s.State = None
+	s.FailCount, s.RunCount, s.RestartCount, s.ReplaceCount, s.TimeoutCount = 0, 0, 0, 0, 0
+	s.PingLatency, s.PingFailures = 0, 0
+	for i, r := range b.Replicas {
+		rs := r.status
+		if i == 0 || rs.State.availability() > s.State.availability() {
+			s.State = rs.State
+		}
+		s.FailCount += rs.FailCount
+		s.RunCount += rs.RunCount
+		s.RestartCount += rs.RestartCount
+		s.ReplaceCount += rs.ReplaceCount
+		s.TimeoutCount += rs.TimeoutCount
+		if rs.PingLatency > s.PingLatency {
+			s.PingLatency = rs.PingLatency
+		}
+		if rs.PingFailures > s.PingFailures {
+			s.PingFailures = rs.PingFailures
+		}
+	}
+}
+
+// collect combines the errors of the replicas into a single error.
+func (b *PluginBroker) collect(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	var out string
+	for i, err := range errs {
+		if err != nil {
+			out += fmt.Sprintf("Replica %d: %s. ", i, err)
+		}
 	}
-	if r != nil {
-		panic(r)
+	if out != "" {
+		return errors.New(out)
 	}
+	return nil
+}
+
+// isRetryable reports whether a failed call can be retried on another replica, since
+// the plugin process was not available or died while the call was in-flight. Errors
+// returned by the plugin itself are delivered as rpc.ServerError and not retried, nor
+// are calls that timed out or were cancelled.
+func isRetryable(err error) bool {
+	if err == ErrStopping || err == ErrTimeout || err == context.Canceled {
+		return false
+	}
+	_, remote := err.(rpc.ServerError)
+	return !remote
 }
 
-// reset resets the state of a plugin.
-func (b *PluginBroker) reset() {
-	b.Port = 0
-	b.client = nil
-	b.Status.State = None
+// ---------------------------------------------------------------------------------
+// BrokerConfiguration
+// ---------------------------------------------------------------------------------
+
+// BrokerConfiguration describes how the processes of a plugin are run.
+type BrokerConfiguration struct {
+	Kind        string               // kind of the plugin, defaults to KindPlugin
+	Pool        PoolConfiguration    // process pool of the plugin
+	Logs        LogConfiguration     // capturing of the output of the processes
+	Limits      LimitsConfiguration  // resource limits and privileges of the processes
+	Transport   string               // transport of the processes, TransportTCP or TransportUnix
+	Env         []string             // environment allowlist of the processes: NAME or NAME=value
+	CallTimeout time.Duration        // timeout of calls without a deadline, 0 disables the timeout
+	Circuit     CircuitConfiguration // circuit breaker of the Run calls
+	Queue       QueueConfiguration   // limit of the Run calls in-flight
+	Wasm        WasmConfiguration    // limits of the calls of a plugin of KindWasm
+}
+
+// ---------------------------------------------------------------------------------
+// PoolConfiguration
+// ---------------------------------------------------------------------------------
+
+// Balance strategies of a plugin pool.
+const (
+	RoundRobin    = "round-robin"     // dispatch the calls to the replicas in turn
+	LeastInFlight = "least-in-flight" // dispatch a call to the replica with the fewest in-flight calls
+)
+
+// PoolConfiguration describes the process pool of a plugin.
+type PoolConfiguration struct {
+	Replicas  int    // number of processes of the plugin
+	Balance   string // RoundRobin or LeastInFlight
+	StickyKey string // query parameter that routes related requests to the same replica, optional
+}
+
+// ---------------------------------------------------------------------------------
+// Snapshots
+// ---------------------------------------------------------------------------------
+
+// BrokerSnapshot is a consistent copy of the state of a broker and its replicas.
+type BrokerSnapshot struct {
+	Name        string
+	Kind        string
+	Plugin      string
+	Args        []string
+	Dir         string
+	Maintenance bool
+	Balance     string
+	StickyKey   string
+	Replicas    []ReplicaSnapshot
+	Status      PluginStatus
+	Circuit     CircuitSnapshot
+	Queue       QueueSnapshot
+}
+
+// ReplicaSnapshot is a consistent copy of the state of a replica.
+type ReplicaSnapshot struct {
+	Index        int
+	Port         int
+	Address      string
+	Protocol     int
+	Capabilities []string
+	Codec        string
+	Status       PluginStatus
 }
 
 // ---------------------------------------------------------------------------------
@@ -171,9 +578,15 @@ func (b *PluginBroker) reset() {
 
 // PluginStatus holds relevant information on the state of the plugin resp. the broker.
 type PluginStatus struct {
-	State     State  // current state of the plugin
-	FailCount uint32 // number of crashes of the plugin
-	RunCount  uint32 // number of Run() calls of the plugin
+	State        State         // current state of the plugin
+	FailCount    uint32        // number of crashes of the plugin
+	RunCount     uint32        // number of Run() calls of the plugin
+	RestartCount uint32        // number of restarts done by the supervisor
+	ReplaceCount uint32        // number of replacements of the plugin process
+	TimeoutCount uint32        // number of calls that missed their deadline
+	LastError    string        // reason of the last crash of the plugin
+	PingLatency  time.Duration // latency of the last health check
+	PingFailures uint32        // number of failed health checks in a row
 }
 
 // State is the representation of the plugin state.
@@ -184,6 +597,11 @@ const (
 	Started
 	Handshaked
 	Connected
+	Backoff   // crashed, waiting for the supervisor to restart it
+	Failed    // crash budget used up, the supervisor gave up
+	Stopped   // stopped on purpose, will not be restarted
+	Degraded  // connected, but responding slowly to health checks
+	Unhealthy // connected, but failing health checks
 )
 
 // String implements the Stringer interface and returns an textual representation of the state.
@@ -197,7 +615,55 @@ func (s State) String() string {
 		return "Handshaked"
 	case Connected:
 		return "Connected"
+	case Backoff:
+		return "Backoff"
+	case Failed:
+		return "Failed"
+	case Stopped:
+		return "Stopped"
+	case Degraded:
+		return "Degraded"
+	case Unhealthy:
+		return "Unhealthy"
 	default:
 		return "Unknown"
 	}
 }
+
+// availability ranks the states by how available a plugin in this state is.
+func (s State) availability() int {
+	switch s {
+	case Connected:
+		return 9
+	case Degraded:
+		return 8
+	case Unhealthy:
+		return 7
+	case Handshaked:
+		return 6
+	case Started:
+		return 5
+	case Backoff:
+		return 4
+	case None:
+		return 3
+	case Failed:
+		return 2
+	case Stopped:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// IsConnected reports whether the plugin is connected and accepts calls. This includes
+// plugins that are degraded or unhealthy but not yet restarted.
+func (s State) IsConnected() bool {
+	return s == Connected || s == Degraded || s == Unhealthy
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, so the state is
+// shown by its name instead of its number (e.g. on /admin/brokers).
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
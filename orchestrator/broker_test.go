@@ -0,0 +1,270 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// testOrch is the orchestrator the tests run the sample plugin with. All tests share
+// it, since the RPC functionality of an orchestrator is registered with net/rpc.
+var testOrch *Orchestrator
+
+// samplePath is the binary of the sample plugin, see testdata/sampleplugin.
+var samplePath string
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+// runTests builds the sample plugin and starts the orchestrator of the tests. The
+// tests that need it are skipped if the plugin cannot be built.
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "influxproxy-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	samplePath = filepath.Join(dir, "sampleplugin")
+	out, err := exec.Command("go", "build", "-o", samplePath, "./testdata/sampleplugin").CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Sample plugin could not be built, skipping its tests: %s\n%s", err, out)
+		samplePath = ""
+		return m.Run()
+	}
+
+	testOrch, err = NewOrchestrator(&OrchestratorConfiguration{
+		PluginMinPort:          21300,
+		PluginMaxPort:          21799,
+		PluginHandshakeTimeout: 10 * time.Second,
+		PluginMaxRestarts:      100,
+		PluginBackoffMin:       10 * time.Millisecond,
+		PluginBackoffMax:       100 * time.Millisecond,
+		PluginReplaceTimeout:   10 * time.Second,
+		PluginReplicas:         2,
+		PluginLogLines:         10,
+		PluginCallTimeout:      10 * time.Second,
+	})
+	if err == nil {
+		_, err = testOrch.Start()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	code := m.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testOrch.Stop(ctx)
+	return code
+}
+
+// addSample starts the sample plugin under the given name with the orchestrator of the
+// tests. The plugin is removed when the test ends.
+func addSample(t *testing.T, name string, args ...string) *PluginBroker {
+	t.Helper()
+	if samplePath == "" {
+		t.Skip("Sample plugin not available")
+	}
+	b, err := testOrch.AddPlugin(PluginDefinition{Name: name, Path: samplePath, Args: args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		testOrch.RemovePlugin(ctx, name)
+	})
+	return b
+}
+
+// pid returns the pid of the current process of the replica, 0 if there is none.
+func (r *Replica) pid() int {
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.current == nil || r.current.cmd.Process == nil {
+		return 0
+	}
+	return r.current.cmd.Process.Pid
+}
+
+// waitFor polls the condition until it holds or the timeout passed.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// samplePid returns the pid the sample plugin answered with.
+func samplePid(t *testing.T, reply *plugin.Response) int {
+	t.Helper()
+	if reply == nil || len(reply.Series) != 1 || len(reply.Series[0].Points) != 1 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	pid, err := strconv.Atoi(fmt.Sprint(reply.Series[0].Points[0][0]))
+	if err != nil {
+		t.Fatalf("unexpected pid in reply: %s", err)
+	}
+	return pid
+}
+
+// marshalUntil marshals the registry of the orchestrator like /admin/brokers does,
+// until the returned function is called.
+func marshalUntil(t *testing.T) func() {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := json.Marshal(testOrch.Registry); err != nil {
+				t.Errorf("registry could not be marshaled: %s", err)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestBrokerConcurrentRuns(t *testing.T) {
+	b := addSample(t, "concurrent-runs")
+	defer marshalUntil(t)()
+
+	const calls = 40
+	var wg sync.WaitGroup
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := url.Values{"sleep": {"5ms"}}
+			if i%4 == 0 {
+				q.Set("fail", "bad data")
+			}
+			reply, err := b.Run(plugin.Request{Query: q})
+			if err == nil && (i%4 == 0) != (reply.Error != "") {
+				err = fmt.Errorf("call %d got reply %+v", i, reply)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	s := b.Snapshot()
+	if s.Status.RunCount != calls {
+		t.Errorf("RunCount = %d, want %d", s.Status.RunCount, calls)
+	}
+	var sum uint64
+	for _, r := range s.Replicas {
+		sum += uint64(r.Status.RunCount)
+	}
+	if sum != uint64(calls) {
+		t.Errorf("RunCount of the replicas = %d, want %d", sum, calls)
+	}
+}
+
+func TestBrokerReplicaCrashDuringRun(t *testing.T) {
+	b := addSample(t, "crash-during-run")
+	defer marshalUntil(t)()
+
+	type result struct {
+		reply *plugin.Response
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := b.Run(plugin.Request{Query: url.Values{"sleep": {"300ms"}}})
+		done <- result{reply, err}
+	}()
+	var victim *Replica
+	waitFor(t, 5*time.Second, "an in-flight call", func() bool {
+		for _, r := range b.Replicas {
+			if r.inFlight() > 0 {
+				victim = r
+				return true
+			}
+		}
+		return false
+	})
+	pid := victim.pid()
+	victim.abort("killed by the test")
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("Run() = %v, want the call to be retried on the other replica", res.err)
+	}
+	if got := samplePid(t, res.reply); got == pid {
+		t.Errorf("call was answered by the killed process %d", pid)
+	}
+
+	waitFor(t, 10*time.Second, "the restart of the killed replica", func() bool {
+		return victim.state().IsConnected() && victim.pid() != pid
+	})
+	s := b.Snapshot().Replicas[victim.Index].Status
+	if s.RestartCount == 0 || s.LastError != "Plugin killed: killed by the test" {
+		t.Errorf("status of the killed replica = %+v", s)
+	}
+	reply, err := b.Run(plugin.Request{})
+	if err != nil {
+		t.Fatalf("Run() after the restart failed: %s", err)
+	}
+	samplePid(t, reply)
+}
+
+func TestBrokerStreamedRun(t *testing.T) {
+	gob := addSample(t, "stream-gob")
+	grpc := addSample(t, "stream-grpc", "-codec", plugin.CodecGRPC)
+
+	const points = 25000 // RunStream sends at most 10000 points per message
+	call := plugin.Request{Query: url.Values{"points": {strconv.Itoa(points)}}}
+	want, err := gob.Run(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Series) != 2 || len(want.Series[0].Points) != points {
+		t.Fatalf("gob reply has %d series, want 2 with %d points in the first", len(want.Series), points)
+	}
+	got, err := grpc.Run(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		var sizes []int
+		for _, s := range got.Series {
+			sizes = append(sizes, len(s.Points))
+		}
+		t.Errorf("grpc reply with series of %v points differs from the gob reply", sizes)
+	}
+}
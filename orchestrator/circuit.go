@@ -0,0 +1,220 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// ErrCircuitOpen is returned by a broker whose circuit breaker is open, since its
+// plugin failed too often recently. See PluginBroker.RetryAfter.
+var ErrCircuitOpen = errors.New("Plugin circuit is open")
+
+// ---------------------------------------------------------------------------------
+// circuit
+// ---------------------------------------------------------------------------------
+
+// circuit is the circuit breaker of a broker. While it is closed, all calls pass and
+// their outcome is counted per window. As soon as the error rate of a window reaches
+// the threshold, the circuit opens and calls fail fast. After the open duration, the
+// circuit is half-open: a limited number of probe calls pass; if they all succeed,
+// the circuit closes again, otherwise it opens again.
+type circuit struct {
+	conf     CircuitConfiguration
+	mu       sync.Mutex
+	state    CircuitState
+	window   time.Time // start of the current window
+	calls    int       // calls in the current window resp. successful probes
+	failures int       // failed calls in the current window
+	openedAt time.Time // time the circuit opened
+	probes   int       // probe calls in-flight
+}
+
+// newCircuit returns a closed circuit breaker.
+func newCircuit(conf CircuitConfiguration) *circuit {
+	if conf.Probes < 1 {
+		conf.Probes = 1
+	}
+	c := &circuit{
+		conf:   conf,
+		state:  CircuitClosed,
+		window: time.Now(),
+	}
+	return c
+}
+
+// allow reports whether a call may pass. Every allowed call needs to be recorded via
+// record afterwards.
+func (c *circuit) allow() error {
+	if c.conf.Threshold <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == CircuitOpen {
+		if time.Since(c.openedAt) < c.conf.OpenDuration {
+			return ErrCircuitOpen
+		}
+		c.state = CircuitHalfOpen
+		c.calls, c.failures, c.probes = 0, 0, 0
+	}
+	if c.state == CircuitHalfOpen {
+		if c.probes+c.calls >= c.conf.Probes {
+			return ErrCircuitOpen
+		}
+		c.probes++
+	}
+	return nil
+}
+
+// record counts the outcome of an allowed call. Calls that were cancelled by the
+// caller or refused since the plugin is stopping do not count.
+func (c *circuit) record(reply *plugin.Response, err error) {
+	if c.conf.Threshold <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	neutral := err == context.Canceled || err == ErrStopping
+	failed := err != nil || reply == nil || reply.Error != ""
+
+	switch c.state {
+	case CircuitHalfOpen:
+		c.probes--
+		if neutral {
+			return
+		}
+		if failed {
+			c.open()
+			return
+		}
+		c.calls++
+		if c.calls >= c.conf.Probes {
+			c.state = CircuitClosed
+			c.window = time.Now()
+			c.calls, c.failures = 0, 0
+		}
+	case CircuitClosed:
+		if neutral {
+			return
+		}
+		if c.conf.Window > 0 && time.Since(c.window) >= c.conf.Window {
+			c.window = time.Now()
+			c.calls, c.failures = 0, 0
+		}
+		c.calls++
+		if failed {
+			c.failures++
+		}
+		if c.calls >= c.conf.MinRequests && float64(c.failures)/float64(c.calls) >= c.conf.Threshold {
+			c.open()
+		}
+	}
+}
+
+// abort undoes an allowed call that was not made after all.
+func (c *circuit) abort() {
+	if c.conf.Threshold <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == CircuitHalfOpen {
+		c.probes--
+	}
+}
+
+// open opens the circuit. The lock needs to be held by the caller.
+func (c *circuit) open() {
+	c.state = CircuitOpen
+	c.openedAt = time.Now()
+	c.calls, c.failures, c.probes = 0, 0, 0
+}
+
+// retryAfter returns the time until the circuit allows probe calls.
+func (c *circuit) retryAfter() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != CircuitOpen {
+		return 0
+	}
+	d := c.conf.OpenDuration - time.Since(c.openedAt)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// snapshot returns a copy of the state of the circuit.
+func (c *circuit) snapshot() CircuitSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CircuitSnapshot{
+		State:    c.state,
+		Calls:    c.calls,
+		Failures: c.failures,
+	}
+	if c.state == CircuitOpen {
+		openedAt := c.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// ---------------------------------------------------------------------------------
+// CircuitState
+// ---------------------------------------------------------------------------------
+
+// CircuitState is the state of the circuit breaker of a broker.
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // calls pass
+	CircuitOpen                         // calls fail fast
+	CircuitHalfOpen                     // probe calls pass
+)
+
+// String implements the Stringer interface and returns an textual representation of the state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "Closed"
+	case CircuitOpen:
+		return "Open"
+	case CircuitHalfOpen:
+		return "HalfOpen"
+	default:
+		return "Unknown"
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, so the state is
+// shown by its name instead of its number (e.g. on /admin/brokers).
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitSnapshot is a copy of the state of the circuit breaker of a broker.
+type CircuitSnapshot struct {
+	State    CircuitState
+	Calls    int        // calls in the current window resp. successful probes
+	Failures int        // failed calls in the current window
+	OpenedAt *time.Time `json:",omitempty"` // time the circuit opened, if open
+}
+
+// ---------------------------------------------------------------------------------
+// CircuitConfiguration
+// ---------------------------------------------------------------------------------
+
+// CircuitConfiguration describes the circuit breaker of a plugin. Failed calls are
+// calls that returned an error or a Response with an error.
+type CircuitConfiguration struct {
+	Threshold    float64       // error rate (0 to 1) that opens the circuit, 0 disables the breaker
+	MinRequests  int           // calls per window before the error rate is judged
+	Window       time.Duration // length of the window the error rate is measured in, 0 never resets the counters
+	OpenDuration time.Duration // time the circuit stays open before probe calls pass
+	Probes       int           // successful probe calls that close the circuit again
+}
@@ -0,0 +1,68 @@
+package orchestrator
+
+import (
+	"context"
+	"net/rpc"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// ---------------------------------------------------------------------------------
+// pluginClient
+// ---------------------------------------------------------------------------------
+
+// pluginClient calls the RPC methods of a plugin process, regardless of the codec the
+// process speaks. The calls block until the process answered; only clients whose
+// codec carries deadlines give up as soon as the context is done.
+type pluginClient interface {
+	Ping(ctx context.Context) (bool, error)
+	Describe(ctx context.Context) (*plugin.Description, error)
+	Run(ctx context.Context, data plugin.Request) (*plugin.Response, error)
+	Shutdown() // asks the process to exit without waiting for the answer
+	Close() error
+}
+
+// ---------------------------------------------------------------------------------
+// rpcClient
+// ---------------------------------------------------------------------------------
+
+// rpcClient is the pluginClient of processes that speak a net/rpc codec (CodecGob or
+// CodecJSON). net/rpc cannot abandon a call, so the contexts are ignored.
+type rpcClient struct {
+	c *rpc.Client
+}
+
+// Ping implements pluginClient.
+func (c *rpcClient) Ping(ctx context.Context) (bool, error) {
+	var reply bool
+	call := new([]interface{})
+	err := c.c.Call("Connector.Ping", *call, &reply)
+	return reply, err
+}
+
+// Describe implements pluginClient.
+func (c *rpcClient) Describe(ctx context.Context) (*plugin.Description, error) {
+	var reply *plugin.Description
+	call := new([]interface{})
+	err := c.c.Call("Connector.Describe", *call, &reply)
+	return reply, err
+}
+
+// Run implements pluginClient.
+func (c *rpcClient) Run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	var reply *plugin.Response
+	err := c.c.Call("Connector.Run", data, &reply)
+	return reply, err
+}
+
+// Shutdown implements pluginClient.
+func (c *rpcClient) Shutdown() {
+	var reply bool
+	call := new([]interface{})
+	c.c.Go("Connector.Shutdown", *call, &reply, nil)
+}
+
+// Close implements pluginClient.
+func (c *rpcClient) Close() error {
+	return c.c.Close()
+}
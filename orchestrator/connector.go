@@ -1,9 +1,10 @@
 package orchestrator
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/rpc"
+	"path/filepath"
 
 	"github.com/influxproxy/influxproxy/plugin"
 )
@@ -16,43 +17,87 @@ import (
 // the plugins.
 type Connector struct {
 	Registry *BrokerRegistry
+	orch     *Orchestrator
 }
 
-// NewConnector returns an initialized connector.
-func NewConnector(reg *BrokerRegistry) *Connector {
+// NewConnector returns an initialized connector of the given orchestrator.
+func NewConnector(orch *Orchestrator) *Connector {
 	o := &Connector{
-		Registry: reg,
+		Registry: orch.Registry,
+		orch:     orch,
 	}
 	return o
 }
 
 // Handshake is exposed via RPC. Every plugin needs to call this method.
 // The plugin fingerprint identifies the plugin and allows the connector
-// to find its relevant broker. Only if the handshake succeeded, the
-// plugin is considered 'connected' and accessable for the orchestrator.
-// It also adds the RPC client to the plugin broker.
+// to find its relevant broker and the plugin process (instance) the
+// broker launched. The plugin needs to present the token it was launched
+// with, otherwise it is rejected. A plugin that speaks an incompatible
+// protocol version is rejected and killed. Only if the handshake succeeded, the plugin is
+// considered 'connected' and accessable for the orchestrator.
+// It also adds the RPC client to the plugin instance.
 func (c *Connector) Handshake(p plugin.Fingerprint, ok *bool) error {
 	b := c.Registry.GetBrokerByName(p.Name)
 	if b == nil {
 		*ok = false
 		return errors.New("Plugin broker not found for " + p.Name)
 	}
-	b.Port = p.Port
-	b.Status.State = Handshaked
-	client, err := c.connect(b)
+	r, inst := b.lookup(p.Token)
+	if inst == nil {
+		*ok = false
+		return errors.New("Plugin instance not found for " + p.Name + " or invalid token")
+	}
+	err := plugin.CheckProtocol(p.Protocol)
+	if err != nil {
+		*ok = false
+		inst.abort(err.Error())
+		return err
+	}
+	address, err := c.address(p)
 	if err != nil {
 		*ok = false
 		return err
 	}
-	b.client = client
-	b.Status.State = Connected
-	ping, err := b.Ping()
+	b.mu.Lock()
+	inst.port = p.Port
+	inst.address = address
+	inst.protocol = p.Protocol
+	if inst.protocol == 0 {
+		inst.protocol = 1
+	}
+	inst.capabilities = plugin.CommonCapabilities(p.Capabilities)
+	codec := inst.codec
+	b.mu.Unlock()
+	if r.state() == Started {
+		r.setState(Handshaked)
+	}
+	client, err := c.connect(address, inst, codec)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	ping, err := client.Ping(context.Background())
 	*ok = ping
 	if err != nil {
+		client.Close()
 		return errors.New("Plugin could not be pinged")
 	}
+	b.mu.Lock()
+	if inst.client != nil {
+		b.mu.Unlock()
+		client.Close()
+		return errors.New("Plugin instance of " + p.Name + " is already connected")
+	}
+	inst.client = client
+	b.mu.Unlock()
 
-	b.readyChan <- true // this unblocks the Spinup of the broker
+	// this unblocks the Spinup resp. the Replace of the replica
+	select {
+	case inst.ready <- true:
+	default:
+	}
 	return nil
 }
 
@@ -64,12 +109,32 @@ func (c *Connector) Ping(in []*interface{}, pong *bool) error {
 	return nil
 }
 
-// connect gets the RPC client required to talk to the plugins.
-func (c *Connector) connect(b *PluginBroker) (*rpc.Client, error) {
-	connStr := fmt.Sprintf("%s:%v", localhost, b.Port)
-	client, err := rpc.Dial("tcp", connStr)
+// address returns the address of the RPC server of the plugin. Sockets of plugins
+// need to be located in the private directory of the orchestrator.
+func (c *Connector) address(p plugin.Fingerprint) (string, error) {
+	if c.orch.Config.PluginTransport == TransportUnix {
+		if p.Address == "" || filepath.Dir(p.Address) != c.orch.socketDir {
+			return "", errors.New("Plugin socket '" + p.Address + "' is not located in " + c.orch.socketDir)
+		}
+		return p.Address, nil
+	}
+	return fmt.Sprintf("%s:%v", localhost, p.Port), nil
+}
+
+// connect gets the RPC client required to talk to the plugins. The orchestrator
+// presents its token to the plugin process and verifies the token of the process
+// before any call is made. The client speaks the codec the process chose.
+func (c *Connector) connect(address string, inst *instance, codec string) (pluginClient, error) {
+	if codec == plugin.CodecGRPC {
+		conn, err := plugin.DialGRPC(c.orch.Config.PluginTransport, address, inst.orchToken, inst.pluginToken)
+		if err != nil {
+			return nil, err
+		}
+		return newGRPCClient(conn, inst.supports(plugin.CapabilityStream)), nil
+	}
+	conn, err := plugin.DialAuthenticated(c.orch.Config.PluginTransport, address, inst.orchToken, inst.pluginToken, codec)
 	if err != nil {
 		return nil, err
 	}
-	return client, nil
+	return &rpcClient{c: plugin.NewClient(codec, conn)}, nil
 }
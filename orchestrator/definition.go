@@ -0,0 +1,93 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------
+// PluginDefinition
+// ---------------------------------------------------------------------------------
+
+// PluginDefinition describes a single plugin the orchestrator runs. Several plugins
+// may share the same binary as long as their names differ.
+type PluginDefinition struct {
+	Name        string   `json:"name"`        // name of the plugin, defaults to the name of the binary
+	Kind        string   `json:"kind"`        // KindPlugin (default), KindExec, KindHTTP or KindWasm
+	Path        string   `json:"path"`        // file system path of the plugin binary, resp. the module of KindWasm
+	URL         string   `json:"url"`         // endpoint of a plugin of KindHTTP
+	Args        []string `json:"args"`        // command-line arguments of the plugin
+	Env         []string `json:"env"`         // additional environment allowlist of the plugin: NAME or NAME=value
+	Dir         string   `json:"dir"`         // working directory of the plugin, defaults to the one of the orchestrator
+	Timeout     string   `json:"timeout"`     // timeout of calls to the plugin (e.g. "5s"), defaults to PluginCallTimeout
+	MaxInFlight int      `json:"maxinflight"` // maximum number of calls in-flight, defaults to PluginQueue
+	QueueLength int      `json:"queuelength"` // maximum number of waiting calls, defaults to PluginQueue
+	MaxMemory   uint64   `json:"maxmemory"`   // memory of each call of KindWasm in bytes, defaults to PluginWasm
+	Fuel        uint64   `json:"fuel"`        // function calls of each call of KindWasm, defaults to PluginWasm
+
+	Limits *LimitsDefinition `json:"limits"` // resource limits and privileges, override PluginLimits
+}
+
+// LoadPluginDefinitions reads the plugin definitions from a JSON file that holds a
+// list of definitions, e.g.
+//
+//	[{"name": "csv-eu", "path": "/opt/plugins/csv", "args": ["-sep", ";"], "env": ["TZ=Europe/Zurich"]},
+//	 {"name": "xml", "path": "/opt/plugins/xml", "limits": {"maxmemory": 268435456, "maxcpu": "60s"}}]
+func LoadPluginDefinitions(path string) ([]PluginDefinition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var defs []PluginDefinition
+	err = json.Unmarshal(data, &defs)
+	if err != nil {
+		return nil, errors.New("Invalid plugin configuration file '" + path + "': " + err.Error())
+	}
+	return defs, nil
+}
+
+// name returns the name of the plugin.
+func (d PluginDefinition) name() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return filepath.Base(d.Path)
+}
+
+// validate checks that the definition names a binary, resp. the endpoint of an HTTP
+// plugin, and that the name can be used in URLs.
+func (d PluginDefinition) validate() error {
+	if d.Kind == KindHTTP {
+		if d.Name == "" {
+			return errors.New("Plugin of url '" + d.URL + "' has no name. ")
+		}
+		u, err := url.Parse(d.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Plugin '" + d.Name + "' has no valid http or https url. ")
+		}
+	} else if d.Path == "" {
+		return errors.New("Plugin '" + d.Name + "' has no path. ")
+	}
+	if strings.ContainsAny(d.name(), "/ ?#%") {
+		return errors.New("Plugin name '" + d.name() + "' must not contain '/', ' ', '?', '#' or '%'. ")
+	}
+	if d.Kind != "" && d.Kind != KindPlugin && d.Kind != KindExec && d.Kind != KindHTTP && d.Kind != KindWasm {
+		return errors.New("Plugin '" + d.name() + "' has an unknown kind '" + d.Kind + "'. ")
+	}
+	if d.Timeout != "" {
+		if _, err := time.ParseDuration(d.Timeout); err != nil {
+			return errors.New("Plugin '" + d.name() + "' has an invalid timeout: " + err.Error() + ". ")
+		}
+	}
+	if d.Limits != nil && d.Limits.MaxCPU != "" {
+		if _, err := time.ParseDuration(d.Limits.MaxCPU); err != nil {
+			return errors.New("Plugin '" + d.name() + "' has an invalid CPU time limit: " + err.Error() + ". ")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package orchestrator
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PluginPrefix is the prefix of the binaries that are discovered in the plugin
+// directory. The name of the plugin is the name of the binary without the prefix.
+const PluginPrefix = "influxproxy-plugin-"
+
+// DiscoverPlugins returns the definitions of all executables in the given directory
+// whose name starts with PluginPrefix.
+func DiscoverPlugins(dir string) ([]PluginDefinition, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var defs []PluginDefinition
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, PluginPrefix) || len(name) == len(PluginPrefix) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path) // follows symlinks
+		if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			continue
+		}
+		defs = append(defs, PluginDefinition{
+			Name: strings.TrimPrefix(name, PluginPrefix),
+			Path: path,
+		})
+	}
+	return defs, nil
+}
+
+// WatchDir scans the plugin directory every PluginDirInterval until the orchestrator
+// is stopped and registers new plugins as they appear. A binary is only registered
+// once its modification time did not change between two scans, so binaries that are
+// still being copied are not started. Binaries that were already present before are
+// not registered again, even if their broker was removed in the meantime.
+func (w *Watcher) WatchDir() {
+	conf := w.orch.Config
+	if conf.PluginDir == "" || conf.PluginDirInterval <= 0 {
+		return
+	}
+
+	known := make(map[string]bool)
+	for _, b := range w.orch.Registry.Brokers() {
+		known[b.Plugin] = true
+	}
+	pending := make(map[string]time.Time)
+
+	for {
+		select {
+		case <-w.orch.quit:
+			return
+		case <-time.After(conf.PluginDirInterval):
+		}
+
+		defs, err := DiscoverPlugins(conf.PluginDir)
+		if err != nil {
+			continue
+		}
+		for _, def := range defs {
+			if known[def.Path] {
+				continue
+			}
+			info, err := os.Stat(def.Path)
+			if err != nil {
+				continue
+			}
+			if seen, ok := pending[def.Path]; !ok || !seen.Equal(info.ModTime()) {
+				pending[def.Path] = info.ModTime()
+				continue
+			}
+			delete(pending, def.Path)
+			known[def.Path] = true
+			b, err := w.orch.AddPlugin(def)
+			if b == nil {
+				log.Printf("Plugin '%s' in the plugin directory could not be registered: %s", def.Path, strings.TrimSpace(err.Error()))
+			} else if err != nil {
+				log.Printf("Plugin '%s' in the plugin directory could not be started: %s", def.Path, err)
+			}
+		}
+	}
+}
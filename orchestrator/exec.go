@@ -0,0 +1,289 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// execWaitDelay is the time the output of a command is read after it was killed,
+// e.g. since subprocesses still hold its stdout.
+const execWaitDelay = time.Second
+
+// ---------------------------------------------------------------------------------
+// execRunner
+// ---------------------------------------------------------------------------------
+
+// execRunner serves the calls of a plugin of KindExec: every Run call starts the
+// command of the plugin, with the body of the request on its stdin and the query in
+// its environment:
+//
+//	QUERY_STRING   the encoded query, e.g. "db=metrics&tag=a"
+//	QUERY_<NAME>   the first value of each query parameter; the name is upper case,
+//	               characters other than letters and digits are replaced by '_'. Of
+//	               names that end up the same, the first in sorted order is passed;
+//	               a parameter named "string" is only part of QUERY_STRING
+//	PLUGIN_NAME    the name of the plugin
+//
+// The command writes the series as JSON to its stdout: either a list of series or an
+// object like plugin.Response, e.g.
+//
+//	[{"name": "cpu", "columns": ["value"], "points": [[0.5]]}]
+//
+// If the command exits with a status other than 0, its stderr (or its exit status) is
+// returned as error of the Response. Commands that are killed or cannot be started
+// fail the call. The stderr of the commands is captured in the log buffer of the
+// broker, the resource limits of the broker apply to each command.
+type execRunner struct {
+	broker  *PluginBroker
+	path    string // path of the command, looked up by start
+	mu      sync.Mutex
+	running map[*exec.Cmd]struct{} // commands in-flight
+	wg      sync.WaitGroup
+}
+
+// newExecRunner returns the runner of an exec plugin.
+func newExecRunner(b *PluginBroker) *execRunner {
+	e := &execRunner{
+		broker:  b,
+		running: make(map[*exec.Cmd]struct{}),
+	}
+	return e
+}
+
+// start implements runner by checking that the command is executable.
+func (e *execRunner) start() error {
+	path, err := exec.LookPath(e.broker.Plugin)
+	if err != nil {
+		return err
+	}
+	if e.broker.Dir != "" {
+		if _, err := os.Stat(e.broker.Dir); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	e.path = path
+	e.mu.Unlock()
+	return nil
+}
+
+// ping implements runner. Commands are only run on demand, so there is nothing to
+// ping.
+func (e *execRunner) ping(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+// describe implements runner.
+func (e *execRunner) describe(ctx context.Context) (*plugin.Description, error) {
+	command := strings.Join(append([]string{e.broker.Plugin}, e.broker.Args...), " ")
+	d := &plugin.Description{
+		Description: "Runs '" + command + "' for each request",
+	}
+	return d, nil
+}
+
+// run implements runner by running the command once.
+func (e *execRunner) run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	b := e.broker
+	if !b.State().IsConnected() {
+		return nil, errNotConnected
+	}
+	start := time.Now()
+	stdout := &limitedBuffer{max: maxOutput}
+	stderr := &limitedBuffer{max: maxErrorLength, tail: true}
+	logs := newLogWriter(b, 0, Stderr, b.config.Logs.Forward)
+
+	e.mu.Lock()
+	path := e.path
+	e.mu.Unlock()
+	cmd := exec.CommandContext(ctx, path, b.Args...)
+	cmd.Dir = b.Dir
+	cmd.Env = append(allowedEnv(b.config.Env), queryEnv(data.Query)...)
+	cmd.Env = append(cmd.Env, "PLUGIN_NAME="+b.Name)
+	cmd.Stdin = bytes.NewReader(data.Body)
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(logs, stderr)
+	cmd.SysProcAttr = sysProcAttr()
+	cmd.WaitDelay = execWaitDelay
+
+	err := e.exec(cmd)
+	logs.flush()
+	if ctx.Err() != nil {
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		msg := "Command timed out after " + time.Since(start).Round(time.Millisecond).String()
+		b.updateStatus(func(s *PluginStatus) {
+			s.TimeoutCount += 1
+			s.LastError = msg
+		})
+		return nil, ErrTimeout
+	}
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.Exited() {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = "Command exited with status " + strconv.Itoa(exit.ExitCode())
+		}
+		b.updateStatus(func(s *PluginStatus) {
+			s.RunCount += 1
+			s.LastError = msg
+		})
+		return &plugin.Response{Error: msg}, nil
+	}
+	if err == nil && stdout.overflow {
+		err = errors.New("Command wrote more than " + strconv.Itoa(maxOutput) + " bytes")
+	}
+	if err == nil {
+		var reply *plugin.Response
+		reply, err = decodeResponse(stdout.Bytes())
+		if err == nil {
+			b.updateStatus(func(s *PluginStatus) {
+				s.RunCount += 1
+			})
+			return reply, nil
+		}
+	}
+	b.updateStatus(func(s *PluginStatus) {
+		s.FailCount += 1
+		s.LastError = err.Error()
+	})
+	return nil, err
+}
+
+// exec runs the command with the resource limits of the broker and waits for it.
+func (e *execRunner) exec(cmd *exec.Cmd) error {
+	limits := e.broker.config.Limits
+	e.mu.Lock()
+	if e.broker.isStopping() {
+		e.mu.Unlock()
+		return ErrStopping
+	}
+	err := limitCommand(cmd, limits)
+	if err != nil {
+		e.mu.Unlock()
+		return errors.New("Plugin limits could not be applied: " + err.Error())
+	}
+	err = cmd.Start()
+	if err != nil {
+		e.mu.Unlock()
+		return err
+	}
+	e.running[cmd] = struct{}{}
+	e.wg.Add(1)
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.running, cmd)
+		e.mu.Unlock()
+		e.wg.Done()
+	}()
+
+	err = cmd.Wait()
+	if breach := limits.breach(cmd.ProcessState); err != nil && breach != "" {
+		return errors.New("Command killed: " + breach)
+	}
+	return err
+}
+
+// stop implements runner. Commands still running when the context is done are killed.
+func (e *execRunner) stop(ctx context.Context) error {
+	e.mu.Lock() // no command starts once the broker is stopping
+	e.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	e.mu.Lock()
+	for cmd := range e.running {
+		cmd.Process.Kill()
+	}
+	e.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// queryEnv returns the environment variables that pass the query to a command. The
+// parameters are taken in the order of their names: if several names map onto the same
+// variable, the first one wins. Names that map onto QUERY_STRING are only passed there.
+func queryEnv(query map[string][]string) []string {
+	env := []string{"QUERY_STRING=" + url.Values(query).Encode()}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	set := map[string]bool{"STRING": true}
+	for _, k := range keys {
+		v := query[k]
+		if len(v) == 0 {
+			continue
+		}
+		name := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' {
+				return r - 'a' + 'A'
+			}
+			if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, k)
+		if set[name] {
+			continue
+		}
+		set[name] = true
+		env = append(env, "QUERY_"+name+"="+v[0])
+	}
+	return env
+}
+
+// ---------------------------------------------------------------------------------
+// limitedBuffer
+// ---------------------------------------------------------------------------------
+
+// limitedBuffer keeps at most max bytes written to it: the first ones, or the last ones
+// if tail is set. Further output is dropped without failing the writer.
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int
+	tail     bool
+	overflow bool // set as soon as output was dropped
+}
+
+// Write implements io.Writer.
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if l.tail {
+		l.Buffer.Write(p)
+		if extra := l.Len() - l.max; extra > 0 {
+			l.Next(extra)
+			l.overflow = true
+		}
+		return n, nil
+	}
+	if free := l.max - l.Len(); len(p) > free {
+		p = p[:free]
+		l.overflow = true
+	}
+	l.Buffer.Write(p)
+	return n, nil
+}
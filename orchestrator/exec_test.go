@@ -0,0 +1,37 @@
+package orchestrator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		query map[string][]string
+		want  []string
+	}{
+		{
+			name:  "parameters",
+			query: map[string][]string{"db": {"metrics"}, "tag": {"a", "b"}, "empty": {}},
+			want:  []string{"QUERY_STRING=db=metrics&tag=a&tag=b", "QUERY_DB=metrics", "QUERY_TAG=a"},
+		},
+		{
+			name:  "reserved name",
+			query: map[string][]string{"string": {"forged"}, "String": {"forged"}},
+			want:  []string{"QUERY_STRING=String=forged&string=forged"},
+		},
+		{
+			name:  "collision",
+			query: map[string][]string{"a_b": {"2"}, "a-b": {"1"}, "A.B": {"0"}},
+			want:  []string{"QUERY_STRING=A.B=0&a-b=1&a_b=2", "QUERY_A_B=0"},
+		},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ { // the order of the map must not matter
+			if got := queryEnv(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%s: queryEnv() = %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	}
+}
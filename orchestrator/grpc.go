@@ -0,0 +1,137 @@
+package orchestrator
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+
+	"github.com/influxproxy/influxproxy/plugin"
+	"github.com/influxproxy/influxproxy/plugin/pluginpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ---------------------------------------------------------------------------------
+// grpcConnector
+// ---------------------------------------------------------------------------------
+
+// grpcConnector exposes the functionality of the Connector via gRPC, for the plugins
+// that speak CodecGRPC.
+type grpcConnector struct {
+	pluginpb.UnimplementedOrchestratorServer
+	c *Connector
+}
+
+// Handshake implements pluginpb.OrchestratorServer, see Connector.Handshake.
+func (g *grpcConnector) Handshake(ctx context.Context, in *pluginpb.Fingerprint) (*pluginpb.HandshakeReply, error) {
+	var ok bool
+	err := g.c.Handshake(plugin.FingerprintFromProto(in), &ok)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginpb.HandshakeReply{Ok: ok}, nil
+}
+
+// Ping implements pluginpb.OrchestratorServer, see Connector.Ping.
+func (g *grpcConnector) Ping(ctx context.Context, in *pluginpb.Empty) (*pluginpb.PingReply, error) {
+	var pong bool
+	err := g.c.Ping(nil, &pong)
+	return &pluginpb.PingReply{Pong: pong}, err
+}
+
+// ---------------------------------------------------------------------------------
+// grpcClient
+// ---------------------------------------------------------------------------------
+
+// grpcClient is the pluginClient of processes that speak CodecGRPC. The deadlines of
+// the contexts are sent along with the calls. Run calls are streamed if the process
+// has the stream capability.
+type grpcClient struct {
+	conn   *grpc.ClientConn
+	c      pluginpb.PluginClient
+	stream bool
+}
+
+// newGRPCClient returns the client of a process on the given connection.
+func newGRPCClient(conn *grpc.ClientConn, stream bool) *grpcClient {
+	c := &grpcClient{
+		conn:   conn,
+		c:      pluginpb.NewPluginClient(conn),
+		stream: stream,
+	}
+	return c
+}
+
+// Ping implements pluginClient.
+func (c *grpcClient) Ping(ctx context.Context) (bool, error) {
+	reply, err := c.c.Ping(ctx, &pluginpb.Empty{})
+	if err != nil {
+		return false, grpcError(err)
+	}
+	return reply.GetPong(), nil
+}
+
+// Describe implements pluginClient.
+func (c *grpcClient) Describe(ctx context.Context) (*plugin.Description, error) {
+	reply, err := c.c.Describe(ctx, &pluginpb.Empty{})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return plugin.DescriptionFromProto(reply), nil
+}
+
+// Run implements pluginClient. Streamed responses are put back together.
+func (c *grpcClient) Run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	if !c.stream {
+		reply, err := c.c.Run(ctx, data.Proto())
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		out := &plugin.Response{}
+		out.AddProto(reply)
+		return out, nil
+	}
+
+	stream, err := c.c.RunStream(ctx, data.Proto())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	out := &plugin.Response{}
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		out.AddProto(reply)
+	}
+}
+
+// Shutdown implements pluginClient.
+func (c *grpcClient) Shutdown() {
+	go c.c.Shutdown(context.Background(), &pluginpb.Empty{})
+}
+
+// Close implements pluginClient.
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// grpcError translates gRPC errors to the errors of net/rpc: errors returned by the
+// plugin become an rpc.ServerError, so they are not retried on other replicas. Errors
+// of the connection are passed on.
+func grpcError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.Canceled, codes.DeadlineExceeded:
+		return err
+	default:
+		return rpc.ServerError(s.Message())
+	}
+}
@@ -0,0 +1,104 @@
+package orchestrator
+
+import (
+	"fmt"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------
+// HealthChecker
+// ---------------------------------------------------------------------------------
+
+// HealthChecker pings the connected plugins periodically. Plugins that respond slowly
+// are marked as Degraded, plugins that do not respond in time are marked as Unhealthy.
+// A plugin that fails PluginHealthThreshold checks in a row is killed, so the
+// supervisor restarts it.
+type HealthChecker struct {
+	orch *Orchestrator
+}
+
+// NewHealthChecker returns a health checker for the plugins of the given orchestrator.
+func NewHealthChecker(orch *Orchestrator) *HealthChecker {
+	h := &HealthChecker{
+		orch: orch,
+	}
+	return h
+}
+
+// Check runs the health checks of the given replica every PluginHealthInterval until
+// the plugin is stopped. A ping that takes longer than half of PluginHealthTimeout
+// is considered slow.
+func (h *HealthChecker) Check(r *Replica) {
+	conf := h.orch.Config
+	if conf.PluginHealthInterval <= 0 {
+		return
+	}
+
+	var failures uint32
+	for !r.broker.isStopping() {
+		time.Sleep(conf.PluginHealthInterval)
+		if !r.state().IsConnected() {
+			failures = 0
+			continue
+		}
+
+		latency, err := r.healthCheck(conf.PluginHealthTimeout)
+		failures = h.record(r.update, latency, err, failures)
+		if err != nil && int(failures) >= conf.PluginHealthThreshold {
+			r.abort(fmt.Sprintf("%d health checks failed in a row, last one with: %s", failures, err))
+			failures = 0
+		}
+	}
+}
+
+// CheckRunner is like Check, but for a plugin without replicas (see runner). Since
+// there is no process to restart, the plugin just stays Unhealthy as long as it fails
+// the health checks.
+func (h *HealthChecker) CheckRunner(b *PluginBroker) {
+	conf := h.orch.Config
+	if conf.PluginHealthInterval <= 0 {
+		return
+	}
+
+	var failures uint32
+	for !b.isStopping() {
+		time.Sleep(conf.PluginHealthInterval)
+		if !b.State().IsConnected() {
+			failures = 0
+			continue
+		}
+
+		latency, err := b.healthCheck(conf.PluginHealthTimeout)
+		failures = h.record(b.updateStatus, latency, err, failures)
+	}
+}
+
+// record applies the outcome of a health check to a status and returns the number of
+// failed checks in a row.
+func (h *HealthChecker) record(update func(func(s *PluginStatus)), latency time.Duration, err error, failures uint32) uint32 {
+	if err == nil {
+		update(func(s *PluginStatus) {
+			s.PingLatency = latency
+			s.PingFailures = 0
+			if !s.State.IsConnected() {
+				return // the plugin ended in the meantime
+			}
+			if latency > h.orch.Config.PluginHealthTimeout/2 {
+				s.State = Degraded
+			} else {
+				s.State = Connected
+			}
+		})
+		return 0
+	}
+
+	failures++
+	update(func(s *PluginStatus) {
+		s.PingLatency = latency
+		s.PingFailures = failures
+		if s.State.IsConnected() {
+			s.State = Unhealthy
+		}
+	})
+	return failures
+}
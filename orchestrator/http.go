@@ -0,0 +1,283 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// ---------------------------------------------------------------------------------
+// httpRunner
+// ---------------------------------------------------------------------------------
+
+// httpRunner serves the calls of a plugin of KindHTTP by forwarding them to an
+// external HTTP service. Every Run call becomes a POST request to the URL of the
+// plugin: the query of the call is added to the query of the URL, the body and the
+// header of the call are sent along. The service answers with the series as JSON,
+// either a list of series or an object like plugin.Response, e.g.
+//
+//	{"Series": [{"name": "cpu", "columns": ["value"], "points": [[0.5]]}], "Error": ""}
+//
+// Answers with a 4xx status are errors of the data: their body (or the Error of the
+// response) is returned as error of the Response. Answers with a 5xx status fail the
+// call. Health checks send a GET request to the URL; any answer below 500 means the
+// service is up.
+type httpRunner struct {
+	broker *PluginBroker
+	url    *url.URL // endpoint of the service, parsed by start
+	client *http.Client
+	mu     sync.Mutex
+	wg     sync.WaitGroup     // calls in-flight
+	abort  context.Context    // done as soon as the calls in-flight are aborted by stop
+	cancel context.CancelFunc // aborts the calls in-flight
+}
+
+// newHTTPRunner returns the runner of an HTTP plugin.
+func newHTTPRunner(b *PluginBroker) *httpRunner {
+	h := &httpRunner{
+		broker: b,
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse // a redirected POST would lose its body
+			},
+		},
+	}
+	h.abort, h.cancel = context.WithCancel(context.Background())
+	return h
+}
+
+// start implements runner by parsing the URL of the plugin. Whether the service is up
+// is left to the health checks, so it may start after the orchestrator.
+func (h *httpRunner) start() error {
+	u, err := url.Parse(h.broker.Plugin)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Unsupported scheme '" + u.Scheme + "' of url '" + h.broker.Plugin + "'")
+	}
+	h.mu.Lock()
+	h.url = u
+	h.mu.Unlock()
+	return nil
+}
+
+// ping implements runner by sending a GET request to the service.
+func (h *httpRunner) ping(ctx context.Context) (bool, error) {
+	resp, err := h.do(ctx, http.MethodGet, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorLength))
+	if resp.StatusCode >= 500 {
+		return false, errors.New("Plugin answered with status " + resp.Status)
+	}
+	return true, nil
+}
+
+// describe implements runner.
+func (h *httpRunner) describe(ctx context.Context) (*plugin.Description, error) {
+	d := &plugin.Description{
+		Description: "Forwards requests to " + h.broker.Plugin,
+	}
+	return d, nil
+}
+
+// run implements runner by forwarding the call to the service.
+func (h *httpRunner) run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	b := h.broker
+	if !b.State().IsConnected() {
+		return nil, errNotConnected
+	}
+	start := time.Now()
+
+	resp, err := h.do(ctx, http.MethodPost, data.Query, data.Header, data.Body)
+	var out []byte
+	if err == nil {
+		out, err = io.ReadAll(io.LimitReader(resp.Body, maxOutput+1))
+		resp.Body.Close()
+		if err == nil && len(out) > maxOutput {
+			err = errors.New("Plugin answered with more than " + strconv.Itoa(maxOutput) + " bytes")
+		}
+	}
+	if ctx.Err() != nil {
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		msg := "Request timed out after " + time.Since(start).Round(time.Millisecond).String()
+		b.updateStatus(func(s *PluginStatus) {
+			s.TimeoutCount += 1
+			s.LastError = msg
+		})
+		return nil, ErrTimeout
+	}
+
+	if err == nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		msg := errorMessage(out)
+		if msg == "" {
+			msg = "Plugin answered with status " + resp.Status
+		}
+		b.updateStatus(func(s *PluginStatus) {
+			s.RunCount += 1
+			s.LastError = msg
+		})
+		return &plugin.Response{Error: msg}, nil
+	}
+	if err == nil && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		msg := "Plugin answered with status " + resp.Status
+		if text := errorMessage(out); text != "" {
+			msg += ": " + text
+		}
+		err = errors.New(msg)
+	}
+	if err == nil {
+		var reply *plugin.Response
+		reply, err = decodeResponse(out)
+		if err == nil {
+			b.updateStatus(func(s *PluginStatus) {
+				s.RunCount += 1
+			})
+			return reply, nil
+		}
+	}
+	b.updateStatus(func(s *PluginStatus) {
+		s.FailCount += 1
+		s.LastError = err.Error()
+	})
+	return nil, err
+}
+
+// do sends a request to the service. The query is added to the one of the URL of the
+// plugin. Requests are refused as soon as the plugin is stopping.
+func (h *httpRunner) do(ctx context.Context, method string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	h.mu.Lock()
+	if h.broker.isStopping() {
+		h.mu.Unlock()
+		return nil, ErrStopping
+	}
+	if h.url == nil {
+		h.mu.Unlock()
+		return nil, errNotConnected
+	}
+	u := *h.url
+	h.wg.Add(1)
+	h.mu.Unlock()
+
+	ctx, cancelCtx := context.WithCancel(ctx)
+	stopAbort := context.AfterFunc(h.abort, cancelCtx)
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			stopAbort()
+			cancelCtx()
+			h.wg.Done()
+		})
+	}
+	if len(query) > 0 {
+		q := u.Query()
+		for k, v := range query {
+			q[k] = append(q[k], v...)
+		}
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Del("Content-Length")
+	req.Header.Del("Accept-Encoding") // leave compression to the transport
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// stop implements runner. Requests still in-flight when the context is done are
+// aborted.
+func (h *httpRunner) stop(ctx context.Context) error {
+	h.mu.Lock() // no request starts once the broker is stopping
+	h.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		h.cancel()
+		<-done
+		err = ctx.Err()
+	}
+	h.client.CloseIdleConnections()
+	return err
+}
+
+// errorMessage returns the error message of an answer of a service: the Error of the
+// response it holds or its text.
+func errorMessage(out []byte) string {
+	if reply, err := decodeResponse(out); err == nil && reply.Error != "" {
+		return reply.Error
+	}
+	msg := strings.TrimSpace(string(out))
+	if len(msg) > maxErrorLength {
+		msg = msg[:maxErrorLength]
+	}
+	return msg
+}
+
+// privateHeader lists the header fields that are not passed on to the plugins: the
+// hop-by-hop fields and the credentials of the client.
+var privateHeader = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Authorization", "Cookie",
+}
+
+// CallHeader returns the header of an HTTP request as passed on to the plugins, i.e.
+// as Header of a plugin.Request: without the hop-by-hop fields, including the ones
+// listed in the Connection field, and without the credentials of the client.
+func CallHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, f := range h["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			out.Del(strings.TrimSpace(k))
+		}
+	}
+	for _, k := range privateHeader {
+		out.Del(k)
+	}
+	return out
+}
+
+// cancelBody releases a request as soon as its response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.
+func (c *cancelBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,289 @@
+package orchestrator
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// newHTTPBroker returns a started broker of an HTTP plugin that forwards to the given
+// URL. The broker is stopped when the test ends.
+func newHTTPBroker(t *testing.T, url string, conf BrokerConfiguration) *PluginBroker {
+	t.Helper()
+	conf.Kind = KindHTTP
+	b, err := NewPluginBroker("http", url, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Spinup(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		b.Stop(ctx)
+	})
+	return b
+}
+
+func TestHTTPRunnerAnswers(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantNames []string // series of the response
+		wantError string   // Error of the response
+		wantErr   bool     // the call fails
+	}{
+		{
+			name:      "list",
+			status:    200,
+			body:      `[{"name": "cpu", "columns": ["value"], "points": [[0.5]]}, {"name": "mem", "columns": ["value"], "points": [[1]]}]`,
+			wantNames: []string{"cpu", "mem"},
+		},
+		{
+			name:      "object",
+			status:    200,
+			body:      `{"Series": [{"name": "cpu", "columns": ["value"], "points": [[0.5]]}], "Error": ""}`,
+			wantNames: []string{"cpu"},
+		},
+		{
+			name:      "object with error",
+			status:    200,
+			body:      `{"Series": null, "Error": "no points"}`,
+			wantError: "no points",
+		},
+		{
+			name:      "client error text",
+			status:    400,
+			body:      "line 3 cannot be parsed\n",
+			wantError: "line 3 cannot be parsed",
+		},
+		{
+			name:      "client error object",
+			status:    422,
+			body:      `{"Error": "unknown unit"}`,
+			wantError: "unknown unit",
+		},
+		{
+			name:      "client error without body",
+			status:    404,
+			wantError: "Plugin answered with status 404 Not Found",
+		},
+		{
+			name:    "server error",
+			status:  500,
+			body:    "boom",
+			wantErr: true,
+		},
+		{
+			name:    "invalid output",
+			status:  200,
+			body:    "not json",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+			b := newHTTPBroker(t, srv.URL, BrokerConfiguration{})
+
+			reply, err := b.Run(plugin.Request{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Run() = %+v, want an error", reply)
+				}
+				if b.Snapshot().Status.FailCount != 1 {
+					t.Errorf("FailCount = %d, want 1", b.Snapshot().Status.FailCount)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run() failed: %s", err)
+			}
+			if reply.Error != tt.wantError {
+				t.Errorf("Error = %q, want %q", reply.Error, tt.wantError)
+			}
+			var names []string
+			for _, s := range reply.Series {
+				names = append(names, s.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("series = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestHTTPRunnerCircuit(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "unavailable", 503)
+	}))
+	defer srv.Close()
+	b := newHTTPBroker(t, srv.URL, BrokerConfiguration{
+		Circuit: CircuitConfiguration{Threshold: 0.5, MinRequests: 2, Window: time.Minute, OpenDuration: time.Minute},
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := b.Run(plugin.Request{})
+		if err == nil {
+			t.Fatalf("call %d succeeded, want an error", i)
+		}
+	}
+	if s := b.Snapshot().Circuit.State; s != CircuitOpen {
+		t.Fatalf("circuit after 2 failures = %s, want %s", s, CircuitOpen)
+	}
+	_, err := b.Run(plugin.Request{})
+	if err != ErrCircuitOpen {
+		t.Errorf("Run() with open circuit = %v, want %v", err, ErrCircuitOpen)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("service got %d calls, want 2", n)
+	}
+}
+
+func TestHTTPRunnerTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	b := newHTTPBroker(t, srv.URL, BrokerConfiguration{CallTimeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := b.Run(plugin.Request{})
+	if err != ErrTimeout {
+		t.Fatalf("Run() = %v, want %v", err, ErrTimeout)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Run() returned after %s, want about 50ms", d)
+	}
+	if n := b.Snapshot().Status.TimeoutCount; n != 1 {
+		t.Errorf("TimeoutCount = %d, want 1", n)
+	}
+}
+
+func TestHTTPRunnerRequest(t *testing.T) {
+	type received struct {
+		method string
+		path   string
+		query  url.Values
+		header http.Header
+		body   string
+	}
+	got := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.Method, r.URL.Path, r.URL.Query(), r.Header, string(body)}
+		io.WriteString(w, "[]")
+	}))
+	defer srv.Close()
+	b := newHTTPBroker(t, srv.URL+"/convert?format=csv&sep=%3B", BrokerConfiguration{})
+
+	header := CallHeader(http.Header{
+		"Content-Type":  {"text/csv"},
+		"Authorization": {"Basic c2VjcmV0"},
+	})
+	_, err := b.Run(plugin.Request{
+		Query:  url.Values{"series": {"cpu"}, "sep": {","}},
+		Body:   []byte("1;2\n"),
+		Header: header,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-got
+	if r.method != http.MethodPost || r.path != "/convert" {
+		t.Errorf("request = %s %s, want POST /convert", r.method, r.path)
+	}
+	want := url.Values{"format": {"csv"}, "sep": {";", ","}, "series": {"cpu"}}
+	if !reflect.DeepEqual(r.query, want) {
+		t.Errorf("query = %v, want %v", r.query, want)
+	}
+	if r.body != "1;2\n" {
+		t.Errorf("body = %q, want %q", r.body, "1;2\n")
+	}
+	if ct := r.header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", ct)
+	}
+	if auth := r.header.Get("Authorization"); auth != "" {
+		t.Errorf("Authorization = %q, want it stripped", auth)
+	}
+}
+
+func TestCallHeader(t *testing.T) {
+	in := http.Header{
+		"Content-Type":  {"text/csv"},
+		"X-Source":      {"sensor-1"},
+		"Authorization": {"Bearer secret"},
+		"Cookie":        {"session=1"},
+		"Connection":    {"keep-alive, X-Hop", "X-Other"},
+		"Keep-Alive":    {"timeout=5"},
+		"X-Hop":         {"1"},
+		"X-Other":       {"2"},
+		"Te":            {"trailers"},
+		"Upgrade":       {"h2c"},
+	}
+	out := CallHeader(in)
+	want := http.Header{
+		"Content-Type": {"text/csv"},
+		"X-Source":     {"sensor-1"},
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("CallHeader() = %v, want %v", out, want)
+	}
+	if in.Get("Authorization") == "" || in.Get("X-Hop") == "" {
+		t.Errorf("CallHeader() modified its argument: %v", in)
+	}
+}
+
+func TestHTTPRunnerHealthCheck(t *testing.T) {
+	var status int32 = 200
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("health check sent %s, want GET", r.Method)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+	b := newHTTPBroker(t, srv.URL, BrokerConfiguration{})
+	h := NewHealthChecker(&Orchestrator{Config: &OrchestratorConfiguration{
+		PluginHealthInterval: 10 * time.Millisecond,
+		PluginHealthTimeout:  time.Second,
+	}})
+	go h.CheckRunner(b)
+
+	state := func(want State) func() bool {
+		return func() bool { return b.State() == want }
+	}
+	waitFor(t, 2*time.Second, "a connected plugin", state(Connected))
+	atomic.StoreInt32(&status, 404) // answers below 500 mean the service is up
+	time.Sleep(50 * time.Millisecond)
+	if s := b.State(); s != Connected {
+		t.Fatalf("state with status 404 = %s, want %s", s, Connected)
+	}
+	atomic.StoreInt32(&status, 503)
+	waitFor(t, 2*time.Second, "an unhealthy plugin", state(Unhealthy))
+	if n := b.Snapshot().Status.PingFailures; n == 0 {
+		t.Errorf("PingFailures = 0, want failures to be counted")
+	}
+	atomic.StoreInt32(&status, 200)
+	waitFor(t, 2*time.Second, "a recovered plugin", state(Connected))
+}
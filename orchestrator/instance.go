@@ -0,0 +1,115 @@
+package orchestrator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// ---------------------------------------------------------------------------------
+// instance
+// ---------------------------------------------------------------------------------
+
+// instance is a single process of a plugin. Usually a broker has exactly one instance;
+// while the plugin is replaced, the new instance runs next to the old one until it
+// has completed its handshake.
+type instance struct {
+	cmd           *exec.Cmd      // plugin process
+	checksum      string         // checksum of the binary the process was started from
+	pluginToken   string         // token the process needs to present to the orchestrator
+	orchToken     string         // token the orchestrator presents to the process
+	port          int            // port of the RPC server of the process
+	address       string         // address (host:port or socket path) of the RPC server of the process
+	client        pluginClient   // RPC client connected to the process
+	protocol      int            // protocol version negotiated in the handshake
+	capabilities  []string       // capabilities shared with the process
+	codec         string         // codec the process speaks, named on its first connection
+	stdout        *logWriter     // captures the stdout of the process
+	stderr        *logWriter     // captures the stderr of the process
+	ready         chan bool      // receives a value as soon as the handshake is completed
+	done          chan struct{}  // closed as soon as the process ended
+	err           error          // reason why the process ended
+	retired       bool           // set as soon as the instance is taken out of service on purpose
+	mu            sync.Mutex     // guards reason
+	reason        string         // reason why the process was killed by the orchestrator
+	inflight      sync.WaitGroup // in-flight calls
+	inflightCount int32          // number of in-flight calls, used for load balancing
+}
+
+// newInstance returns the instance of a plugin process that is about to be started.
+func newInstance(cmd *exec.Cmd, checksum string, pluginToken string, orchToken string) *instance {
+	i := &instance{
+		cmd:         cmd,
+		checksum:    checksum,
+		pluginToken: pluginToken,
+		orchToken:   orchToken,
+		ready:       make(chan bool, 1),
+		done:        make(chan struct{}),
+	}
+	return i
+}
+
+// supports reports whether the process shares the given capability. The capabilities
+// are set by the handshake, before the instance is used.
+func (i *instance) supports(c string) bool {
+	return plugin.HasCapability(i.capabilities, c)
+}
+
+// kill kills the process of the instance immediately.
+func (i *instance) kill() {
+	i.cmd.Process.Kill()
+}
+
+// enter registers an in-flight call.
+func (i *instance) enter() {
+	i.inflight.Add(1)
+	atomic.AddInt32(&i.inflightCount, 1)
+}
+
+// release marks an in-flight call as done.
+func (i *instance) release() {
+	atomic.AddInt32(&i.inflightCount, -1)
+	i.inflight.Done()
+}
+
+// calls returns the number of in-flight calls.
+func (i *instance) calls() int32 {
+	return atomic.LoadInt32(&i.inflightCount)
+}
+
+// abort kills the process of the instance and records the reason.
+func (i *instance) abort(reason string) {
+	i.mu.Lock()
+	i.reason = reason
+	i.mu.Unlock()
+	i.kill()
+}
+
+// killReason returns the reason why the process was killed by the orchestrator, if so.
+func (i *instance) killReason() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.reason
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of the given file.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
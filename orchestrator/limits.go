@@ -0,0 +1,132 @@
+package orchestrator
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// errShimMissing is returned for limits of a program that did not call ShimMain.
+var errShimMissing = errors.New("Plugin limits require the program to call orchestrator.ShimMain first")
+
+// shimReady is set by ShimMain, as soon as the program can be started as shim.
+var shimReady bool
+
+// ---------------------------------------------------------------------------------
+// LimitsConfiguration
+// ---------------------------------------------------------------------------------
+
+// LimitsConfiguration describes the resource limits and the privileges of the processes
+// of a plugin. The limits are applied by the orchestrator before the plugin binary is
+// executed, plugins do not need to be aware of them. Limits are only supported on Linux.
+type LimitsConfiguration struct {
+	MaxMemory    uint64        // address space in bytes, 0 means unlimited
+	MaxCPU       time.Duration // CPU time, 0 means unlimited
+	MaxOpenFiles uint64        // open file descriptors, 0 means unlimited
+	Nice         int           // nice level (-20 to 19), 0 keeps the level of the orchestrator
+	Uid          uint32        // user the processes run as, 0 keeps the user of the orchestrator
+	Gid          uint32        // group the processes run as, 0 keeps the group of the orchestrator
+}
+
+// isSet reports whether any limit or privilege change is configured.
+func (l LimitsConfiguration) isSet() bool {
+	return l != LimitsConfiguration{}
+}
+
+// validate checks the limits for values the kernel would reject and whether they can
+// be applied at all.
+func (l LimitsConfiguration) validate(transport string) error {
+	if l.isSet() && !limitsSupported {
+		return errors.New("Plugin limits are only supported on Linux")
+	}
+	if l.isSet() && !shimReady {
+		return errShimMissing
+	}
+	if l.Nice < -20 || l.Nice > 19 {
+		return errors.New("Nice level " + strconv.Itoa(l.Nice) + " is out of range (-20 to 19)")
+	}
+	if l.MaxCPU > 0 && l.MaxCPU < time.Second {
+		return errors.New("CPU time limit needs to be at least 1s")
+	}
+	if (l.Uid != 0 || l.Gid != 0) && transport == TransportUnix {
+		return errors.New("Plugins that run as another user require the tcp transport")
+	}
+	return nil
+}
+
+// breach returns a description of the limit a plugin process exceeded, or an empty
+// string. The kernel does not record why a process ended, so the limit is judged by
+// the way it ended:
+//
+//   - CPU time: killed by SIGXCPU or SIGKILL after it used up its CPU time
+//   - memory: ended by a signal typical of failed allocations (SIGSEGV, SIGBUS,
+//     SIGABRT, SIGKILL) or with exit status ENOMEM
+//   - open files: exit status EMFILE
+//
+// Processes that handle a breach on their own are reported by their exit status, e.g.
+// Go programs exit with status 2 if an allocation fails, like they do on a panic.
+func (l LimitsConfiguration) breach(state *os.ProcessState) string {
+	if state == nil || state.Success() {
+		return ""
+	}
+	sig, signaled := exitSignal(state)
+	how := "exit status " + strconv.Itoa(state.ExitCode())
+	if signaled {
+		how = "signal: " + sig.String()
+	}
+	// the CPU time reported for the process may be slightly below the one the kernel
+	// enforced the limit on
+	cpu := state.UserTime() + state.SystemTime()
+	if l.MaxCPU > 0 && signaled && cpuLimitSignal(sig) && cpu >= l.MaxCPU.Truncate(time.Second)*9/10 {
+		return "CPU time limit of " + l.MaxCPU.String() + " exceeded (" + how + ")"
+	}
+	if l.MaxMemory > 0 && (signaled && memoryLimitSignal(sig) || !signaled && state.ExitCode() == int(syscall.ENOMEM)) {
+		return "Memory limit of " + strconv.FormatUint(l.MaxMemory, 10) + " bytes exceeded (" + how + ")"
+	}
+	if l.MaxOpenFiles > 0 && !signaled && state.ExitCode() == int(syscall.EMFILE) {
+		return "Open files limit of " + strconv.FormatUint(l.MaxOpenFiles, 10) + " exceeded (" + how + ")"
+	}
+	return ""
+}
+
+// ---------------------------------------------------------------------------------
+// LimitsDefinition
+// ---------------------------------------------------------------------------------
+
+// LimitsDefinition overrides the limits of the configuration for a single plugin, see
+// PluginDefinition. Fields that are not set keep the limits of the configuration, 0
+// lifts a limit.
+type LimitsDefinition struct {
+	MaxMemory    *uint64 `json:"maxmemory"`    // address space in bytes
+	MaxCPU       string  `json:"maxcpu"`       // CPU time (e.g. "30s")
+	MaxOpenFiles *uint64 `json:"maxopenfiles"` // open file descriptors
+	Nice         *int    `json:"nice"`         // nice level (-20 to 19)
+	Uid          *uint32 `json:"uid"`          // user the processes run as
+	Gid          *uint32 `json:"gid"`          // group the processes run as
+}
+
+// override returns the given limits with the ones of the definition applied. The CPU
+// time needs to be validated beforehand.
+func (d *LimitsDefinition) override(l LimitsConfiguration) LimitsConfiguration {
+	if d.MaxMemory != nil {
+		l.MaxMemory = *d.MaxMemory
+	}
+	if d.MaxCPU != "" {
+		l.MaxCPU, _ = time.ParseDuration(d.MaxCPU)
+	}
+	if d.MaxOpenFiles != nil {
+		l.MaxOpenFiles = *d.MaxOpenFiles
+	}
+	if d.Nice != nil {
+		l.Nice = *d.Nice
+	}
+	if d.Uid != nil {
+		l.Uid = *d.Uid
+	}
+	if d.Gid != nil {
+		l.Gid = *d.Gid
+	}
+	return l
+}
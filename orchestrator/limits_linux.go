@@ -0,0 +1,170 @@
+//go:build linux
+// +build linux
+
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// limitsSupported reports whether plugin limits can be applied on this platform.
+const limitsSupported = true
+
+// shimName is the name (argv[0]) the shim is started with, see limitCommand.
+const shimName = "influxproxy-limits-shim"
+
+// limitsSpec is what the shim needs to know to start a plugin process.
+type limitsSpec struct {
+	Path   string              // plugin binary
+	Parent int                 // pid of the orchestrator
+	Limits LimitsConfiguration // limits to apply
+}
+
+// ShimMain makes the program the shim that applies the limits of a plugin process, if
+// the orchestrator started it as one (see limitCommand): the limits are applied and the
+// process is replaced by the plugin binary. Otherwise ShimMain returns right away.
+// Programs that run plugins with limits call it first thing in main; the orchestrator
+// refuses limits if it was not called.
+func ShimMain() {
+	if len(os.Args) < 3 || os.Args[0] != shimName {
+		shimReady = true
+		return
+	}
+	err := shim(os.Args[1], os.Args[2:])
+	os.Stderr.WriteString("Plugin limits could not be applied: " + err.Error() + "\n")
+	os.Exit(126)
+}
+
+// limitCommand makes the command start the plugin binary through the shim, so that the
+// process is limited before the binary is executed. The shim is the binary of the
+// orchestrator itself, started under shimName with the limits as first argument: its
+// ShimMain applies the limits to its own process and replaces itself by the plugin
+// binary. The arguments the plugin sees are unchanged.
+func limitCommand(cmd *exec.Cmd, l LimitsConfiguration) error {
+	if !l.isSet() {
+		return nil
+	}
+	if !shimReady {
+		return errShimMissing
+	}
+	spec, err := json.Marshal(limitsSpec{
+		Path:   cmd.Path,
+		Parent: os.Getpid(),
+		Limits: l,
+	})
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{shimName, string(spec)}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+// shim runs in the child process of a plugin with limits, before the plugin binary is
+// executed: it applies the limits and replaces the process by the plugin binary, which
+// gets the given arguments. It only returns if that failed.
+func shim(spec string, args []string) error {
+	var s limitsSpec
+	err := json.Unmarshal([]byte(spec), &s)
+	if err != nil {
+		return err
+	}
+	l := s.Limits
+
+	// the nice level and the credentials are properties of the thread on Linux; the
+	// thread that executes the plugin binary passes them on to all threads of the plugin
+	runtime.LockOSThread()
+	if l.MaxMemory > 0 {
+		if err := setrlimit(syscall.RLIMIT_AS, l.MaxMemory); err != nil {
+			return err
+		}
+	}
+	if l.MaxCPU > 0 {
+		if err := setrlimit(syscall.RLIMIT_CPU, uint64(l.MaxCPU/time.Second)); err != nil {
+			return err
+		}
+	}
+	if l.MaxOpenFiles > 0 {
+		if err := setrlimit(syscall.RLIMIT_NOFILE, l.MaxOpenFiles); err != nil {
+			return err
+		}
+	}
+	if l.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, l.Nice); err != nil {
+			return os.NewSyscallError("setpriority", err)
+		}
+	}
+	if l.Uid != 0 || l.Gid != 0 {
+		if err := setCredential(l, s.Parent); err != nil {
+			return err
+		}
+	}
+
+	return os.NewSyscallError("exec "+s.Path, syscall.Exec(s.Path, args, os.Environ()))
+}
+
+// setrlimit sets the soft and the hard limit of a resource of the process.
+func setrlimit(resource int, value uint64) error {
+	err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value})
+	if err != nil {
+		return os.NewSyscallError("setrlimit", err)
+	}
+	return nil
+}
+
+// setCredential drops the calling thread to the user and group of the limits. Changing
+// the credentials clears the parent-death signal, so it is set again; if the
+// orchestrator died in the meantime, an error is returned.
+func setCredential(l LimitsConfiguration, parent int) error {
+	uid, gid := uintptr(os.Getuid()), uintptr(os.Getgid())
+	if l.Uid != 0 {
+		uid = uintptr(l.Uid)
+	}
+	if l.Gid != 0 {
+		gid = uintptr(l.Gid)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESGID, gid, gid, gid); errno != 0 {
+		return os.NewSyscallError("setresgid", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, uid, uid, uid); errno != 0 {
+		return os.NewSyscallError("setresuid", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(syscall.SIGKILL), 0); errno != 0 {
+		return os.NewSyscallError("prctl", errno)
+	}
+	if os.Getppid() != parent {
+		return errors.New("Orchestrator " + strconv.Itoa(parent) + " ended")
+	}
+	return nil
+}
+
+// exitSignal returns the signal that ended the process, if any.
+func exitSignal(state *os.ProcessState) (syscall.Signal, bool) {
+	if state == nil {
+		return 0, false
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, false
+	}
+	return ws.Signal(), true
+}
+
+// cpuLimitSignal reports whether the kernel kills processes that used up their CPU
+// time with the signal: SIGXCPU at the soft limit, SIGKILL at the hard limit.
+func cpuLimitSignal(sig syscall.Signal) bool {
+	return sig == syscall.SIGXCPU || sig == syscall.SIGKILL
+}
+
+// memoryLimitSignal reports whether processes that fail to allocate memory typically
+// end with the signal.
+func memoryLimitSignal(sig syscall.Signal) bool {
+	return sig == syscall.SIGSEGV || sig == syscall.SIGBUS || sig == syscall.SIGABRT || sig == syscall.SIGKILL
+}
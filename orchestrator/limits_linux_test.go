@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package orchestrator
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestLimitsBreach(t *testing.T) {
+	limits := LimitsConfiguration{MaxMemory: 1 << 30, MaxCPU: time.Minute, MaxOpenFiles: 64}
+	tests := []struct {
+		script string
+		limits LimitsConfiguration
+		want   string
+	}{
+		{"exit 0", limits, ""},
+		{"exit 3", limits, ""},
+		{"kill -SEGV $$", limits, "Memory limit of 1073741824 bytes exceeded (signal: segmentation fault)"},
+		{"kill -KILL $$", limits, "Memory limit of 1073741824 bytes exceeded (signal: killed)"},
+		{"exit 12", limits, "Memory limit of 1073741824 bytes exceeded (exit status 12)"},
+		{"exit 24", limits, "Open files limit of 64 exceeded (exit status 24)"},
+		{"kill -XCPU $$", limits, ""}, // the CPU time was not used up
+		{"kill -SEGV $$", LimitsConfiguration{MaxOpenFiles: 64}, ""},
+		{"exit 24", LimitsConfiguration{MaxMemory: 1 << 30}, ""},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("/bin/sh", "-c", tt.script)
+		cmd.Run()
+		if got := tt.limits.breach(cmd.ProcessState); got != tt.want {
+			t.Errorf("breach() of %q with %+v = %q, want %q", tt.script, tt.limits, got, tt.want)
+		}
+	}
+}
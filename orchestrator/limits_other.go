@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package orchestrator
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// limitsSupported reports whether plugin limits can be applied on this platform.
+const limitsSupported = false
+
+// ShimMain does nothing, limits are only supported on Linux.
+func ShimMain() {
+}
+
+// limitCommand does nothing, limits are only supported on Linux.
+func limitCommand(cmd *exec.Cmd, l LimitsConfiguration) error {
+	return nil
+}
+
+// exitSignal reports no signal, limits are only supported on Linux.
+func exitSignal(state *os.ProcessState) (syscall.Signal, bool) {
+	return 0, false
+}
+
+// cpuLimitSignal reports false, limits are only supported on Linux.
+func cpuLimitSignal(sig syscall.Signal) bool {
+	return false
+}
+
+// memoryLimitSignal reports false, limits are only supported on Linux.
+func memoryLimitSignal(sig syscall.Signal) bool {
+	return false
+}
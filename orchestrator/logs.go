@@ -0,0 +1,189 @@
+package orchestrator
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxLogLineLength limits the length of a captured line; longer output is split.
+const maxLogLineLength = 64 * 1024
+
+// followBuffer is the number of lines a follower may lag behind before lines are
+// dropped for it.
+const followBuffer = 256
+
+// Output streams of a plugin process.
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// ---------------------------------------------------------------------------------
+// LogBuffer
+// ---------------------------------------------------------------------------------
+
+// LogLine is a single line a plugin process wrote to its stdout or stderr.
+type LogLine struct {
+	Time    time.Time // time the line was captured
+	Replica int       // index of the replica whose process wrote the line
+	Stream  string    // Stdout or Stderr
+	Text    string    // the line without its line break
+}
+
+// LogBuffer keeps the latest output lines of the processes of a plugin in a ring
+// buffer of fixed size. The lines can be read at once or followed as they arrive.
+type LogBuffer struct {
+	mu        sync.Mutex
+	lines     []LogLine                 // ring buffer
+	start     int                       // index of the oldest line in the ring buffer
+	size      int                       // maximum number of lines kept
+	followers map[chan LogLine]struct{} // channels of the followers of the buffer
+}
+
+// NewLogBuffer returns an empty log buffer that keeps the given number of lines.
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 1 {
+		size = 1
+	}
+	l := &LogBuffer{
+		size:      size,
+		followers: make(map[chan LogLine]struct{}),
+	}
+	return l
+}
+
+// Add appends a line to the buffer, the oldest line is dropped if the buffer is full.
+// Followers that do not keep up miss the line instead of blocking the plugin.
+func (l *LogBuffer) Add(line LogLine) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.lines) < l.size {
+		l.lines = append(l.lines, line)
+	} else {
+		l.lines[l.start] = line
+		l.start = (l.start + 1) % l.size
+	}
+	for f := range l.followers {
+		select {
+		case f <- line:
+		default:
+		}
+	}
+}
+
+// Lines returns the buffered lines, oldest first.
+func (l *LogBuffer) Lines() []LogLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.snapshot()
+}
+
+// Follow returns the buffered lines and a channel that receives all lines added
+// afterwards. The returned function ends following and needs to be called by the
+// caller as soon as it stops reading from the channel.
+func (l *LogBuffer) Follow() ([]LogLine, <-chan LogLine, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := make(chan LogLine, followBuffer)
+	l.followers[f] = struct{}{}
+	unfollow := func() {
+		l.mu.Lock()
+		delete(l.followers, f)
+		l.mu.Unlock()
+	}
+	return l.snapshot(), f, unfollow
+}
+
+// snapshot copies the lines of the ring buffer in order. The lock needs to be held by
+// the caller.
+func (l *LogBuffer) snapshot() []LogLine {
+	out := make([]LogLine, 0, len(l.lines))
+	out = append(out, l.lines[l.start:]...)
+	out = append(out, l.lines[:l.start]...)
+	return out
+}
+
+// ---------------------------------------------------------------------------------
+// logWriter
+// ---------------------------------------------------------------------------------
+
+// logWriter splits the output stream of a plugin process into lines and adds them to
+// the log buffer of its broker. If forwarding is enabled, the lines are written to
+// the log of the orchestrating program as well, prefixed with the plugin name.
+type logWriter struct {
+	broker  *PluginBroker
+	replica int
+	stream  string
+	forward bool
+	mu      sync.Mutex
+	partial []byte // output after the last line break
+}
+
+// newLogWriter returns a writer for the given stream of a process of the broker, run
+// by the replica of the given index.
+func newLogWriter(b *PluginBroker, replica int, stream string, forward bool) *logWriter {
+	w := &logWriter{
+		broker:  b,
+		replica: replica,
+		stream:  stream,
+		forward: forward,
+	}
+	return w
+}
+
+// Write implements io.Writer.
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	if len(w.partial) >= maxLogLineLength {
+		w.emit(w.partial)
+		w.partial = nil
+	}
+	return len(p), nil
+}
+
+// flush emits output that was not terminated by a line break, e.g. after the process
+// ended.
+func (w *logWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.emit(w.partial)
+		w.partial = nil
+	}
+}
+
+// emit adds a single line to the log buffer. The lock needs to be held by the caller.
+func (w *logWriter) emit(text []byte) {
+	line := LogLine{
+		Time:    time.Now(),
+		Replica: w.replica,
+		Stream:  w.stream,
+		Text:    string(bytes.TrimSuffix(text, []byte("\r"))),
+	}
+	w.broker.logs.Add(line)
+	if w.forward {
+		log.Printf("[%s#%d] %s", w.broker.Name, w.replica, line.Text)
+	}
+}
+
+// ---------------------------------------------------------------------------------
+// LogConfiguration
+// ---------------------------------------------------------------------------------
+
+// LogConfiguration describes how the output of the processes of a plugin is captured.
+type LogConfiguration struct {
+	Lines   int  // number of lines kept per plugin
+	Forward bool // write the output to the log of the orchestrating program as well
+}
@@ -16,17 +16,35 @@
 package orchestrator
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+	"github.com/influxproxy/influxproxy/plugin/pluginpb"
+	"google.golang.org/grpc"
 )
 
 const (
 	localhost = "127.0.0.1"
 )
 
+// Transports between the orchestrator and its plugins.
+const (
+	TransportTCP  = "tcp"  // TCP on localhost, ports are allocated from the plugin port range
+	TransportUnix = "unix" // Unix domain sockets in a private directory of the orchestrator
+)
+
 // ---------------------------------------------------------------------------------
 // Orchestrator
 // ---------------------------------------------------------------------------------
@@ -34,121 +52,390 @@ const (
 // Orchestrator is used to orchestrate the plugins, manage their life cycle and handle
 // the communication between the orchestrating programm and its plugins.
 type Orchestrator struct {
-	Config    *OrchestratorConfiguration // holds all necessary configuration
-	Registry  *BrokerRegistry            // holds all plugin broker information
-	Connector *Connector                 // holds the methodes that are exposed via RPC
-	Port      int                        // holds its own port that is exposed via RPC
+	Config     *OrchestratorConfiguration // holds all necessary configuration
+	Registry   *BrokerRegistry            // holds all plugin broker information
+	Connector  *Connector                 // holds the methodes that are exposed via RPC
+	Supervisor *Supervisor                // restarts crashed plugins
+	Watcher    *Watcher                   // replaces plugins whose binary changed
+	Health     *HealthChecker             // restarts plugins that fail their health checks
+	Port       int                        // holds its own port that is exposed via RPC
+	Address    string                     // holds its own address (host:port or socket path) that is exposed via RPC
+	socketDir  string                     // private directory of the Unix domain sockets
+	socketSeq  uint32                     // counter used to name the sockets of the plugins
+	listener   net.Listener               // listener of the RPC server
+	grpcServer *grpc.Server               // serves the plugins that speak CodecGRPC
+	grpcConns  *plugin.ConnListener       // authenticated connections of these plugins
+	quit       chan struct{}              // closed as soon as the orchestrator is stopped
+	stopOnce   sync.Once
 }
 
 // NewOrchestrator returnd a fully initialized orchestrator and registres the given
-// plugins to its registry.
+// plugins to its registry. All plugins are registered, even if some of them fail; each
+// failed registration is logged, and the returned error lists them all next to the
+// orchestrator, which serves the plugins that were registered. Plugins discovered in the
+// plugin directory that share their name with a configured plugin are skipped with a
+// warning, the configured plugin wins.
 func NewOrchestrator(conf *OrchestratorConfiguration) (*Orchestrator, error) {
-	if conf.PluginMaxPort == 0 || conf.PluginMinPort == 0 {
+	if conf.PluginTransport == "" {
+		conf.PluginTransport = TransportTCP
+	}
+	if conf.PluginTransport != TransportTCP && conf.PluginTransport != TransportUnix {
+		return nil, errors.New("Unknown plugin transport '" + conf.PluginTransport + "'")
+	}
+	if conf.PluginTransport == TransportTCP && (conf.PluginMaxPort == 0 || conf.PluginMinPort == 0) {
 		return nil, errors.New("Insufficent orchestrator configuration")
 	}
-	var out string
-	var err error
-
+	if err := conf.PluginLimits.validate(conf.PluginTransport); err != nil {
+		return nil, err
+	}
 	o := &Orchestrator{
 		Config: conf,
+		quit:   make(chan struct{}),
 	}
 
 	o.Registry = NewBrokerRegistry()
+	o.Supervisor = NewSupervisor(o)
+	o.Watcher = NewWatcher(o)
+	o.Health = NewHealthChecker(o)
+
+	defs := make([]PluginDefinition, 0, len(conf.Plugins))
+	for _, plugin := range conf.Plugins {
+		defs = append(defs, PluginDefinition{Path: plugin})
+	}
+	if conf.PluginConfigFile != "" {
+		fileDefs, err := LoadPluginDefinitions(conf.PluginConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, fileDefs...)
+	}
+	defs = append(defs, conf.PluginDefinitions...)
+	var dirDefs []PluginDefinition
+	if conf.PluginDir != "" {
+		var err error
+		dirDefs, err = DiscoverPlugins(conf.PluginDir)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	for _, plugin := range o.Config.Plugins {
-		err = o.Registry.RegisterBroker(plugin)
+	var failed []string
+	register := func(def PluginDefinition) {
+		_, err := o.Registry.RegisterBroker(def, conf.broker())
 		if err != nil {
-			out += err.Error()
+			msg := strings.TrimSpace(err.Error())
+			log.Printf("Plugin not registered: %s", msg)
+			failed = append(failed, msg)
+		}
+	}
+	for _, def := range defs {
+		register(def)
+	}
+	for _, def := range dirDefs {
+		if b := o.Registry.GetBrokerByName(def.name()); b != nil {
+			log.Printf("Plugin '%s' in the plugin directory is shadowed by the configured plugin '%s' and not registered", def.Path, b.Plugin)
+			continue
 		}
+		register(def)
 	}
 
-	if err != nil {
-		err = errors.New(out)
+	if len(failed) > 0 {
+		return o, errors.New(strings.Join(failed, " "))
 	}
-	return o, err
+	return o, nil
 }
 
-// Start starts the orchestrator instance and all its Plugins.
-func (orch *Orchestrator) Start() ([]string, error) {
-	var err error
-	var messages []string
-
+// Start starts the orchestrator instance and all its Plugins. The plugins are started
+// concurrently; a plugin that does not complete its handshake within
+// PluginHandshakeTimeout is killed. The returned report tells how the start of each
+// plugin went.
+func (orch *Orchestrator) Start() (*StartupReport, error) {
 	// Get the orchestrator itself started. Since spinup() lives forever in order to
-	// serve the RPC connection, it is starded in a goroutine and continues unblocks
-	// as soon as orchChan recieves any value.
-	orchChan := make(chan bool)
-	go func() {
-		err = orch.spinup(orchChan)
-	}()
-	<-orchChan
+	// serve the RPC connection, it is starded in a goroutine and continues as soon
+	// as orchChan recieves the result of the launch.
+	orchChan := make(chan error)
+	go orch.spinup(orchChan)
+	err := <-orchChan
 	if err != nil {
-		messages = append(messages, "Could not launch orchestrator")
-		return messages, err
+		return nil, errors.New("Could not launch orchestrator: " + err.Error())
 	}
 
-	messages = append(messages, fmt.Sprintf("Orchestrator started on port %v.", orch.Port))
+	brokers := orch.Registry.Brokers()
+	report := &StartupReport{
+		Port:    orch.Port,
+		Address: orch.Address,
+		Plugins: make([]PluginReport, len(brokers)),
+	}
 
-	// Get plugins started via their brokers. Since Spinup() lasts as long as the plugin
-	// does not crash, a goroutine and continues unblocks as soon as bChan recieves any value.
-	bChan := make(chan bool)
-	go func() {
-		for _, b := range *orch.Registry {
-			err = b.Spinup(orch)
+	// Get plugins started via their brokers. Spinup() returns as soon as the plugin is
+	// connected, failed or missed its handshake.
+	var wg sync.WaitGroup
+	for i, b := range brokers {
+		wg.Add(1)
+		go func(i int, b *PluginBroker) {
+			defer wg.Done()
+			start := time.Now()
+			err := b.Spinup(orch)
+			r := PluginReport{
+				Name:     b.Name,
+				State:    b.State(),
+				Duration: time.Since(start),
+			}
 			if err != nil {
-				messages = append(messages, fmt.Sprintf("Plugin %s could not be loaded: %s. ", b.Name, err))
-			} else {
-				messages = append(messages, fmt.Sprintf("Plugin %s successfully loaded. ", b.Name))
+				r.Error = err.Error()
 			}
+			report.Plugins[i] = r
+		}(i, b)
+	}
+	wg.Wait()
+
+	// From now on, crashed plugins (and the ones that could not be loaded) are
+	// restarted by the supervisor.
+	for _, b := range brokers {
+		orch.manage(b)
+	}
+	go orch.Watcher.WatchDir()
+	return report, nil
+}
+
+// AddPlugin registers a plugin at runtime and starts it against the running orchestrator.
+// The broker is returned together with the result of the handshake. Like the plugins
+// loaded at startup, the plugin is restarted by the supervisor if it crashes.
+func (orch *Orchestrator) AddPlugin(def PluginDefinition) (*PluginBroker, error) {
+	if orch.listener == nil {
+		return nil, errors.New("Orchestrator not started")
+	}
+	if def.Kind == "" || def.Kind == KindPlugin {
+		if _, err := os.Stat(def.Path); err != nil {
+			return nil, err
 		}
-		bChan <- true
-	}()
-	<-bChan
-	messages = append(messages, "All plugins loaded")
-	return messages, nil
+	}
+
+	b, err := orch.Registry.RegisterBroker(def, orch.Config.broker())
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.Spinup(orch)
+	orch.manage(b)
+	return b, err
+}
+
+// ReplacePlugin replaces the process of the plugin of the given name without
+// downtime, e.g. after a new build of the plugin was deployed. The old process
+// keeps serving until the new one completed its handshake.
+func (orch *Orchestrator) ReplacePlugin(name string) error {
+	b := orch.Registry.GetBrokerByName(name)
+	if b == nil {
+		return errors.New("Broker of plugin '" + name + "' is not registered. ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), orch.Config.PluginReplaceTimeout)
+	defer cancel()
+	return b.Replace(ctx, orch)
+}
+
+// RemovePlugin stops the plugin of the given name and removes its broker from the
+// registry. The broker is removed even if the plugin had to be killed.
+func (orch *Orchestrator) RemovePlugin(ctx context.Context, name string) error {
+	b := orch.Registry.GetBrokerByName(name)
+	if b == nil {
+		return errors.New("Broker of plugin '" + name + "' is not registered. ")
+	}
+
+	err := b.Stop(ctx)
+	orch.Registry.UnregisterBroker(name)
+	return err
+}
+
+// manage hands a broker over to the watcher and its replicas to the supervisor and
+// the health checker. Plugins without replicas are only health checked.
+func (orch *Orchestrator) manage(b *PluginBroker) {
+	if b.runner != nil {
+		go orch.Health.CheckRunner(b)
+		return
+	}
+	for _, r := range b.Replicas {
+		go orch.Supervisor.Supervise(r)
+		go orch.Health.Check(r)
+	}
+	go orch.Watcher.Watch(b)
 }
 
 // spinup starts the orchestrator itself and serves functionality to its plugins via RPC.
 // The port the orchestrator listens to is allocated dynamically and saves to orch.Port.
-func (orch *Orchestrator) spinup(done chan bool) error {
-	connector := NewConnector(orch.Registry)
+// With the Unix transport, the orchestrator listens to a socket in its private directory.
+func (orch *Orchestrator) spinup(done chan error) error {
+	connector := NewConnector(orch)
 	orch.Connector = connector
 
 	rpc.Register(orch.Connector)
 
 	ln, port, err := orch.getListener()
 	if err != nil {
+		done <- err
 		return err
 	}
 
 	orch.Port = port
-	done <- true // before serving the RPC connection, unblock the calling function
+	orch.Address = ln.Addr().String()
+	orch.listener = ln
+	orch.grpcConns = plugin.NewConnListener(ln.Addr())
+	orch.grpcServer = grpc.NewServer()
+	pluginpb.RegisterOrchestratorServer(orch.grpcServer, &grpcConnector{c: connector})
+	go orch.grpcServer.Serve(orch.grpcConns)
+	done <- nil // before serving the RPC connection, unblock the calling function
 
 	for {
 		c, err := ln.Accept()
 		if err != nil {
-			continue
+			select {
+			case <-orch.quit:
+				return nil
+			default:
+				continue
+			}
+		}
+		go orch.serve(c)
+	}
+}
+
+// serve serves the RPC functionality of the orchestrator on the given connection. The
+// connection needs to present the token of a plugin process launched by the
+// orchestrator and receives the orchestrator token of this process in exchange. The
+// codec named along with the token is used for all connections with the process.
+func (orch *Orchestrator) serve(c net.Conn) {
+	c.SetDeadline(time.Now().Add(plugin.AuthTimeout))
+	hello, err := plugin.ReceiveToken(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	token, codec := plugin.ParseHello(hello)
+	if !plugin.SupportsCodec(plugin.Codecs, codec) {
+		c.Close()
+		return
+	}
+	var b *PluginBroker
+	var inst *instance
+	for _, b = range orch.Registry.Brokers() {
+		if _, inst = b.lookup(token); inst != nil {
+			break
 		}
-		go rpc.ServeConn(c)
 	}
+	if inst == nil || plugin.SendToken(c, inst.orchToken) != nil {
+		c.Close()
+		return
+	}
+	b.mu.Lock()
+	inst.codec = codec
+	b.mu.Unlock()
+	c.SetDeadline(time.Time{})
+	if codec == plugin.CodecGRPC {
+		orch.grpcConns.Put(c)
+		return
+	}
+	plugin.ServeConn(codec, c)
+}
+
+// Stop shuts the orchestrator and all its plugins down. The plugins are stopped in
+// parallel: each of them finishes its in-flight Run calls and is asked to exit
+// afterwards. Plugins that are still running when the context is done are killed.
+func (orch *Orchestrator) Stop(ctx context.Context) error {
+	var out string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, b := range orch.Registry.Brokers() {
+		wg.Add(1)
+		go func(b *PluginBroker) {
+			defer wg.Done()
+			err := b.Stop(ctx)
+			if err != nil {
+				mu.Lock()
+				out += err.Error() + ". "
+				mu.Unlock()
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	orch.stopOnce.Do(func() {
+		close(orch.quit)
+		if orch.grpcServer != nil {
+			orch.grpcServer.Stop()
+		}
+		if orch.listener != nil {
+			orch.listener.Close()
+		}
+		if orch.socketDir != "" {
+			os.RemoveAll(orch.socketDir)
+		}
+	})
 
+	if out != "" {
+		return errors.New(out)
+	}
 	return nil
 }
 
 // getEnv prepares the environment variables required to start the plugins. All
-// plugin configuration happens via environment variables.
-func (orch *Orchestrator) getEnv() []string {
-	env := []string{
-		fmt.Sprintf("ORCHESTRATOR_CONN_STRING=%s:%v", localhost, orch.Port),
+// plugin configuration happens via environment variables. The environment of the
+// orchestrator is not passed on, plugins only receive the variables of the given
+// allowlist: an entry NAME passes the variable of the orchestrator environment (if
+// set), an entry NAME=value sets the variable to the value.
+func (orch *Orchestrator) getEnv(allow []string) []string {
+	env := allowedEnv(allow)
+	// the variables of the orchestrator come last and can not be overridden
+	env = append(env,
+		fmt.Sprintf("ORCHESTRATOR_NETWORK=%s", orch.Config.PluginTransport),
+		fmt.Sprintf("ORCHESTRATOR_CONN_STRING=%s", orch.Address),
 		fmt.Sprintf("PLUGIN_MIN_PORT=%d", orch.Config.PluginMinPort),
 		fmt.Sprintf("PLUGIN_MAX_PORT=%d", orch.Config.PluginMaxPort),
+		fmt.Sprintf("ORCHESTRATOR_PROTOCOL=%d", plugin.ProtocolVersion),
+		fmt.Sprintf("ORCHESTRATOR_CAPABILITIES=%s", plugin.FormatCapabilities(plugin.Capabilities)),
+		fmt.Sprintf("ORCHESTRATOR_CODECS=%s", plugin.FormatCapabilities(plugin.Codecs)),
+	)
+	return env
+}
+
+// allowedEnv returns the environment variables of the given allowlist, see getEnv.
+func allowedEnv(allow []string) []string {
+	var env []string
+	for _, e := range allow {
+		if strings.Contains(e, "=") {
+			env = append(env, e)
+		} else if v, ok := os.LookupEnv(e); ok {
+			env = append(env, e+"="+v)
+		}
 	}
-	env = append(os.Environ(), env...)
 	return env
 }
 
+// getSocket returns a new, unique path for the Unix domain socket of a plugin process.
+func (orch *Orchestrator) getSocket() string {
+	seq := atomic.AddUint32(&orch.socketSeq, 1)
+	return filepath.Join(orch.socketDir, fmt.Sprintf("plugin-%d.sock", seq))
+}
+
 // getListener allocates a port from an given range dynamically and returns a listener
-// if any port was available in this range.
+// if any port was available in this range. With the Unix transport, a private
+// directory for the sockets is created and the listener is bound to a socket in it.
 func (orch *Orchestrator) getListener() (net.Listener, int, error) {
+	if orch.Config.PluginTransport == TransportUnix {
+		dir, err := ioutil.TempDir("", "influxproxy-")
+		if err != nil {
+			return nil, 0, err
+		}
+		err = os.Chmod(dir, 0700)
+		if err != nil {
+			return nil, 0, err
+		}
+		orch.socketDir = dir
+		listener, err := net.Listen("unix", filepath.Join(dir, "orchestrator.sock"))
+		return listener, 0, err
+	}
+
 	for port := orch.Config.PluginMinPort; port <= orch.Config.PluginMaxPort; port++ {
 		connection := fmt.Sprintf("%s:%v", localhost, port)
 		listener, err := net.Listen("tcp", connection)
@@ -159,13 +446,80 @@ func (orch *Orchestrator) getListener() (net.Listener, int, error) {
 	return nil, 0, errors.New("Could not get TCP listener, maybe all ports are already used")
 }
 
+// ---------------------------------------------------------------------------------
+// StartupReport
+// ---------------------------------------------------------------------------------
+
+// StartupReport describes the outcome of the start of the orchestrator and its plugins.
+type StartupReport struct {
+	Port    int            // port the orchestrator listens to
+	Address string         // address (host:port or socket path) the orchestrator listens to
+	Plugins []PluginReport // one entry per registered plugin
+}
+
+// PluginReport describes the outcome of the start of a single plugin.
+type PluginReport struct {
+	Name     string        // name of the plugin
+	State    State         // state of the plugin after the start
+	Duration time.Duration // time it took to connect resp. to fail
+	Error    string        // reason why the plugin could not be started, if any
+}
+
 // ---------------------------------------------------------------------------------
 // OrchestratorConfiguration
 // ---------------------------------------------------------------------------------
 
 // OrchestratorConfiguration hold all required configuration data for the orchestrator.
 type OrchestratorConfiguration struct {
-	PluginMinPort int
-	PluginMaxPort int
-	Plugins       []string
+	PluginTransport        string // TransportTCP (default) or TransportUnix
+	PluginMinPort          int
+	PluginMaxPort          int
+	Plugins                []string             // paths of plugin binaries, named after the binary
+	PluginDefinitions      []PluginDefinition   // plugins with a name, arguments, environment or working directory
+	PluginConfigFile       string               // JSON file with further plugin definitions, see LoadPluginDefinitions
+	PluginDir              string               // directory to discover plugins in, see DiscoverPlugins
+	PluginDirInterval      time.Duration        // interval to scan the plugin directory for new plugins, 0 disables scanning
+	PluginHandshakeTimeout time.Duration        // time a started plugin gets to complete its handshake
+	PluginMaxRestarts      int                  // crash budget: restarts in a row before a plugin is given up
+	PluginBackoffMin       time.Duration        // delay before the first restart of a crashed plugin
+	PluginBackoffMax       time.Duration        // upper limit of the restart delay
+	PluginReplaceTimeout   time.Duration        // time a new plugin process gets to replace the old one
+	PluginWatchInterval    time.Duration        // interval to check plugin binaries for changes, 0 disables watching
+	PluginHealthInterval   time.Duration        // interval of the health checks, 0 disables health checking
+	PluginHealthTimeout    time.Duration        // time a plugin gets to respond to a health check
+	PluginHealthThreshold  int                  // failed health checks in a row before a plugin is restarted
+	PluginReplicas         int                  // number of processes per plugin
+	PluginBalance          string               // strategy to dispatch calls among the processes of a plugin
+	PluginStickyKey        string               // query parameter that routes related requests to the same process
+	PluginLogLines         int                  // number of output lines kept per plugin
+	PluginLogForward       bool                 // write the output of the plugins to the log of the program
+	PluginLimits           LimitsConfiguration  // resource limits and privileges of the plugin processes
+	PluginEnv              []string             // environment allowlist of the plugins, see getEnv
+	PluginCallTimeout      time.Duration        // timeout of calls to the plugins, 0 disables the timeout
+	PluginCircuit          CircuitConfiguration // circuit breaker of the plugins
+	PluginQueue            QueueConfiguration   // limit of the calls in-flight per plugin
+	PluginWasm             WasmConfiguration    // limits of the calls of WebAssembly plugins
+}
+
+// broker returns the configuration of the brokers of the plugins.
+func (conf *OrchestratorConfiguration) broker() BrokerConfiguration {
+	b := BrokerConfiguration{
+		Pool: PoolConfiguration{
+			Replicas:  conf.PluginReplicas,
+			Balance:   conf.PluginBalance,
+			StickyKey: conf.PluginStickyKey,
+		},
+		Logs: LogConfiguration{
+			Lines:   conf.PluginLogLines,
+			Forward: conf.PluginLogForward,
+		},
+		Limits:      conf.PluginLimits,
+		Transport:   conf.PluginTransport,
+		Env:         conf.PluginEnv,
+		CallTimeout: conf.PluginCallTimeout,
+		Circuit:     conf.PluginCircuit,
+		Queue:       conf.PluginQueue,
+		Wasm:        conf.PluginWasm,
+	}
+	return b
 }
@@ -0,0 +1,43 @@
+package orchestrator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewOrchestratorKeepsValidPlugins(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"dir", "valid"} {
+		err := os.WriteFile(filepath.Join(dir, PluginPrefix+name), []byte("#!/bin/sh\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, err := NewOrchestrator(&OrchestratorConfiguration{
+		PluginMinPort: 21800,
+		PluginMaxPort: 21899,
+		PluginDir:     dir,
+		PluginDefinitions: []PluginDefinition{
+			{Name: "valid", Kind: KindHTTP, URL: "http://127.0.0.1:1/"},
+			{Name: "invalid", Kind: KindHTTP, URL: "ftp://127.0.0.1/"},
+			{Name: "valid", Kind: KindHTTP, URL: "http://127.0.0.1:2/"},
+		},
+	})
+	if o == nil {
+		t.Fatalf("NewOrchestrator() = nil, %v, want the orchestrator of the valid plugins", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "'invalid'") || !strings.Contains(err.Error(), "'valid'") {
+		t.Errorf("NewOrchestrator() error = %v, want the invalid and the duplicate plugin", err)
+	}
+	for name, url := range map[string]string{"valid": "http://127.0.0.1:1/", "dir": filepath.Join(dir, PluginPrefix+"dir")} {
+		b := o.Registry.GetBrokerByName(name)
+		if b == nil || b.Plugin != url {
+			t.Errorf("plugin %s is %+v, want %s", name, b, url)
+		}
+	}
+	if n := len(o.Registry.Brokers()); n != 2 {
+		t.Errorf("%d plugins registered, want 2", n)
+	}
+}
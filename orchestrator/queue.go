@@ -0,0 +1,259 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// ErrQueueFull is returned by a broker whose plugin runs the maximum number of calls
+// and whose wait queue is full.
+var ErrQueueFull = errors.New("Plugin queue is full")
+
+// ---------------------------------------------------------------------------------
+// Slot
+// ---------------------------------------------------------------------------------
+
+// Slot is the permission to run a single call of a plugin, obtained by Acquire. A slot
+// counts towards the calls in-flight of the plugin until it is released or the call it
+// ran finished in the plugin. Calls abandoned by the caller keep their slot until the
+// plugin answered them, so the plugin never runs more calls than allowed.
+type Slot struct {
+	broker *PluginBroker
+	mu     sync.Mutex
+	done   bool
+	refs   int // holders of the slot while it is run, see hold
+}
+
+// slotKey is the context key of the slot a call runs in.
+type slotKey struct{}
+
+// Acquire waits for a free slot of the plugin, so that a caller can defer expensive
+// preparations (e.g. reading a request body) until the plugin is ready to take the
+// call. ErrCircuitOpen is returned right away while the circuit breaker of the plugin
+// is open, ErrQueueFull if too many calls are waiting already. Contexts without a
+// deadline wait at most the call timeout of the plugin.
+func (b *PluginBroker) Acquire(ctx context.Context) (*Slot, error) {
+	if b.isStopping() {
+		return nil, ErrStopping
+	}
+	err := b.circuit.allow()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := b.WithTimeout(ctx)
+	defer cancel()
+	err = b.queue.acquire(ctx)
+	if err != nil {
+		b.circuit.abort()
+		return nil, err
+	}
+	s := &Slot{
+		broker: b,
+	}
+	return s, nil
+}
+
+// Run sends a Run call to the plugin like PluginBroker.RunContext and frees the slot
+// as soon as the plugin finished the call, which may be after Run returned. A slot can
+// be run only once. A context without a deadline gets the call timeout of its own; use
+// PluginBroker.WithTimeout to share one deadline with Acquire.
+func (s *Slot) Run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	if !s.take() {
+		return nil, errors.New("Plugin slot is used already")
+	}
+	b := s.broker
+	free := s.hold()
+	defer free()
+	ctx, cancel := b.WithTimeout(ctx)
+	defer cancel()
+	ctx = context.WithValue(ctx, slotKey{}, s)
+
+	reply, err := b.run(ctx, data)
+	b.circuit.record(reply, err)
+	return reply, err
+}
+
+// Release frees the slot if it has not been run. It may be called several times, so
+// it is safe to defer it right after acquiring the slot.
+func (s *Slot) Release() {
+	if s.take() {
+		s.broker.circuit.abort()
+		s.broker.queue.release()
+	}
+}
+
+// hold keeps the slot in use until the returned function is called. The slot is freed
+// as soon as all its holders are done.
+func (s *Slot) hold() func() {
+	s.mu.Lock()
+	s.refs++
+	s.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.refs--
+			last := s.refs == 0
+			s.mu.Unlock()
+			if last {
+				s.broker.queue.release()
+			}
+		})
+	}
+}
+
+// holdSlot keeps the slot the call of the context runs in, if any, until the returned
+// function is called. Calls that keep running after their caller gave up use it to
+// hold on to their slot.
+func holdSlot(ctx context.Context) func() {
+	s, ok := ctx.Value(slotKey{}).(*Slot)
+	if !ok {
+		return func() {}
+	}
+	return s.hold()
+}
+
+// take marks the slot as used and reports whether it was unused before.
+func (s *Slot) take() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return false
+	}
+	s.done = true
+	return true
+}
+
+// ---------------------------------------------------------------------------------
+// callQueue
+// ---------------------------------------------------------------------------------
+
+// callQueue bounds the calls in-flight of a plugin. Calls beyond the limit wait in a
+// bounded queue and get a free slot in the order of their arrival.
+type callQueue struct {
+	conf     QueueConfiguration
+	mu       sync.Mutex
+	inFlight int
+	waiting  []chan struct{} // closed as soon as the waiting call got a slot
+	stats    QueueSnapshot
+}
+
+// newCallQueue returns an empty queue.
+func newCallQueue(conf QueueConfiguration) *callQueue {
+	q := &callQueue{
+		conf: conf,
+	}
+	return q
+}
+
+// acquire waits until a call may be sent to the plugin. ErrQueueFull is returned if
+// the queue is full, ErrTimeout if the deadline of the context passed while waiting.
+func (q *callQueue) acquire(ctx context.Context) error {
+	q.mu.Lock()
+	if q.conf.MaxInFlight <= 0 || (q.inFlight < q.conf.MaxInFlight && len(q.waiting) == 0) {
+		q.inFlight++
+		q.mu.Unlock()
+		return nil
+	}
+	if len(q.waiting) >= q.conf.Length {
+		q.stats.Rejected += 1
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	ready := make(chan struct{})
+	q.waiting = append(q.waiting, ready)
+	q.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-ready:
+		q.waited(time.Since(start))
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for i, w := range q.waiting {
+		if w == ready {
+			q.waiting = append(q.waiting[:i:i], q.waiting[i+1:]...)
+			q.stats.Abandoned += 1
+			q.mu.Unlock()
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrTimeout
+			}
+			return ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	// the slot was handed over in the meantime
+	q.waited(time.Since(start))
+	return nil
+}
+
+// release frees the slot of a finished call and hands it over to the longest waiting
+// call, if any.
+func (q *callQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) > 0 {
+		close(q.waiting[0])
+		q.waiting = q.waiting[1:]
+		return
+	}
+	q.inFlight--
+}
+
+// waited adds the wait time of a call that got a slot to the statistics.
+func (q *callQueue) waited(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.Waited += 1
+	q.stats.TotalWait += d
+	if d > q.stats.MaxWait {
+		q.stats.MaxWait = d
+	}
+}
+
+// snapshot returns the current depth of the queue and its statistics.
+func (q *callQueue) snapshot() QueueSnapshot {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats
+	s.MaxInFlight = q.conf.MaxInFlight
+	s.Length = q.conf.Length
+	s.InFlight = q.inFlight
+	s.Depth = len(q.waiting)
+	if s.Waited > 0 {
+		s.AvgWait = s.TotalWait / time.Duration(s.Waited)
+	}
+	return s
+}
+
+// QueueSnapshot is a copy of the state and the statistics of the call queue of a
+// broker. Wait times are in nanoseconds.
+type QueueSnapshot struct {
+	MaxInFlight int           // maximum number of calls in-flight, 0 is unlimited
+	Length      int           // maximum number of waiting calls
+	InFlight    int           // calls in-flight
+	Depth       int           // calls waiting
+	Rejected    uint64        // calls rejected since the queue was full
+	Abandoned   uint64        // calls that gave up waiting
+	Waited      uint64        // calls that had to wait before they got a slot
+	TotalWait   time.Duration // sum of the wait times
+	AvgWait     time.Duration // average wait time of the calls that had to wait
+	MaxWait     time.Duration // longest wait time
+}
+
+// ---------------------------------------------------------------------------------
+// QueueConfiguration
+// ---------------------------------------------------------------------------------
+
+// QueueConfiguration describes how many Run calls a plugin takes at the same time.
+type QueueConfiguration struct {
+	MaxInFlight int // maximum number of calls in-flight, 0 is unlimited
+	Length      int // maximum number of calls waiting for a slot, more are rejected
+}
@@ -1,42 +1,146 @@
 package orchestrator
 
 import (
+	"encoding/json"
 	"errors"
-	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
 )
 
 // ---------------------------------------------------------------------------------
 // BrokerRegistry
 // ---------------------------------------------------------------------------------
 
-// BrokerRegistry keeps references to all registered plugin brokers.
-type BrokerRegistry []*PluginBroker
+// BrokerRegistry keeps references to all registered plugin brokers. The brokers are
+// indexed by their name; the order of registration is kept for listings. A registry
+// is safe for concurrent use.
+type BrokerRegistry struct {
+	mu      sync.RWMutex
+	brokers map[string]*PluginBroker // brokers by name
+	order   []*PluginBroker          // brokers in the order of their registration
+}
 
 // NewBrokerRegistry returns an empty initialized registry
 func NewBrokerRegistry() *BrokerRegistry {
-	return &BrokerRegistry{}
+	return &BrokerRegistry{
+		brokers: make(map[string]*PluginBroker),
+	}
 }
 
-// RegisterBroker takes the file system path to a plugin, initializes a new plugin broker and
-// adds the broker to the registry itself.
-func (r *BrokerRegistry) RegisterBroker(plugin string) error {
-	name := filepath.Base(plugin)
-	for _, b := range *r {
+// RegisterBroker takes the definition of a plugin, initializes a new plugin broker as
+// configured and adds the broker to the registry itself. The environment allowlist of
+// the definition extends the one of the configuration, its limits override the ones of
+// the configuration. Exec and WebAssembly plugins run as many calls at a time as there
+// are CPUs, unless configured otherwise. The registered broker is returned.
+func (r *BrokerRegistry) RegisterBroker(def PluginDefinition, conf BrokerConfiguration) (*PluginBroker, error) {
+	err := def.validate()
+	if err != nil {
+		return nil, err
+	}
+	name := def.name()
+	location := def.Path
+	if def.Kind == KindHTTP {
+		location = def.URL
+	}
+	if r.GetBrokerByName(name) != nil {
+		return nil, errDuplicate(name, location)
+	}
+
+	conf.Env = append(append([]string{}, conf.Env...), def.Env...)
+	conf.Kind = def.Kind
+	if def.Timeout != "" {
+		conf.CallTimeout, _ = time.ParseDuration(def.Timeout)
+	}
+	if def.MaxInFlight > 0 {
+		conf.Queue.MaxInFlight = def.MaxInFlight
+	}
+	if def.QueueLength > 0 {
+		conf.Queue.Length = def.QueueLength
+	}
+	if def.MaxMemory > 0 {
+		conf.Wasm.MaxMemory = def.MaxMemory
+	}
+	if def.Fuel > 0 {
+		conf.Wasm.Fuel = def.Fuel
+	}
+	if def.Limits != nil {
+		conf.Limits = def.Limits.override(conf.Limits)
+		err = conf.Limits.validate(conf.Transport)
+		if err != nil {
+			return nil, errors.New("Plugin '" + name + "' has invalid limits: " + err.Error() + ". ")
+		}
+	}
+	if (def.Kind == KindExec || def.Kind == KindWasm) && conf.Queue.MaxInFlight <= 0 {
+		conf.Queue.MaxInFlight = runtime.NumCPU()
+	}
+	b, err := NewPluginBroker(name, location, conf)
+	if err != nil {
+		return nil, err
+	}
+	b.Args = def.Args
+	b.Dir = def.Dir
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.brokers[name]; ok {
+		return nil, errDuplicate(name, location) // registered concurrently
+	}
+	r.brokers[name] = b
+	r.order = append(r.order, b)
+	return b, nil
+}
+
+// errDuplicate returns the error of a plugin whose name is already registered.
+func errDuplicate(name string, location string) error {
+	return errors.New("Broker of plugin '" + name + "' is already registered, plugin '" + location + "' not registered. ")
+}
+
+// UnregisterBroker removes the broker of the given name from the registry. The plugin
+// itself needs to be stopped beforehand.
+func (r *BrokerRegistry) UnregisterBroker(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.brokers[name]; !ok {
+		return errors.New("Broker of plugin '" + name + "' is not registered. ")
+	}
+	delete(r.brokers, name)
+	for i, b := range r.order {
 		if b.Name == name {
-			return errors.New("Broker of plugin '" + name + "' is already registered, plugin '" + plugin + "' not registered. ")
+			r.order = append(r.order[:i:i], r.order[i+1:]...)
+			break
 		}
 	}
-	b, _ := NewPluginBroker(name, plugin)
-	*r = append(*r, b)
 	return nil
 }
 
 // GetBrokerByName finds a registred plugin broker by its name.
 func (r *BrokerRegistry) GetBrokerByName(name string) *PluginBroker {
-	for _, b := range *r {
-		if b.Name == name {
-			return b
-		}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.brokers[name]
+}
+
+// Brokers returns all registered brokers in the order of their registration. The
+// returned slice is a copy and not affected by later changes of the registry.
+func (r *BrokerRegistry) Brokers() []*PluginBroker {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*PluginBroker(nil), r.order...)
+}
+
+// Snapshot returns a consistent copy of the state of each registered broker.
+func (r *BrokerRegistry) Snapshot() []BrokerSnapshot {
+	brokers := r.Brokers()
+	s := make([]BrokerSnapshot, len(brokers))
+	for i, b := range brokers {
+		s[i] = b.Snapshot()
 	}
-	return nil
+	return s
+}
+
+// MarshalJSON implements the json.Marshaler interface by marshaling a snapshot of the
+// registry.
+func (r *BrokerRegistry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Snapshot())
 }
@@ -0,0 +1,131 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryHandshakeDuringSnapshot(t *testing.T) {
+	if samplePath == "" {
+		t.Skip("Sample plugin not available")
+	}
+	defer marshalUntil(t)()
+
+	const plugins = 4
+	var wg sync.WaitGroup
+	for i := 0; i < plugins; i++ {
+		name := fmt.Sprintf("handshake-%d", i)
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			testOrch.RemovePlugin(ctx, name)
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := testOrch.AddPlugin(PluginDefinition{Name: name, Path: samplePath})
+			if err != nil {
+				t.Errorf("plugin %s failed to start: %s", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < plugins; i++ {
+		name := fmt.Sprintf("handshake-%d", i)
+		b := testOrch.Registry.GetBrokerByName(name)
+		if b == nil {
+			t.Fatalf("plugin %s not registered", name)
+		}
+		s := b.Snapshot()
+		if !s.Status.State.IsConnected() {
+			t.Errorf("plugin %s is %s after its handshake", name, s.Status.State)
+		}
+		for _, r := range s.Replicas {
+			if r.Port == 0 || r.Address == "" || r.Codec == "" {
+				t.Errorf("replica %d of %s lacks its handshake: %+v", r.Index, name, r)
+			}
+		}
+	}
+}
+
+func TestRegistryConcurrentRegisterRemove(t *testing.T) {
+	r := NewBrokerRegistry()
+	conf := BrokerConfiguration{}
+	def := func(name string) PluginDefinition {
+		return PluginDefinition{Name: name, Path: "/opt/plugins/" + name}
+	}
+
+	// all registrations of the same name race, exactly one of them wins
+	const racers = 8
+	var wg sync.WaitGroup
+	won := make(chan *PluginBroker, racers)
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := r.RegisterBroker(def("same"), conf)
+			if err == nil {
+				won <- b
+			}
+		}()
+	}
+	wg.Wait()
+	close(won)
+	if n := len(won); n != 1 {
+		t.Fatalf("%d registrations of the same name succeeded, want 1", n)
+	}
+	if b := <-won; r.GetBrokerByName("same") != b {
+		t.Errorf("registry holds another broker than the one registered")
+	}
+
+	// brokers come and go while the registry is read
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, s := range r.Snapshot() {
+				if s.Name == "" {
+					t.Errorf("snapshot of an unnamed broker")
+				}
+			}
+			r.MarshalJSON()
+		}
+	}()
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("plugin-%d", i)
+			for j := 0; j < 20; j++ {
+				if _, err := r.RegisterBroker(def(name), conf); err != nil {
+					t.Errorf("registration %d of %s failed: %s", j, name, err)
+					return
+				}
+				r.GetBrokerByName(name)
+				if err := r.UnregisterBroker(name); err != nil {
+					t.Errorf("removal %d of %s failed: %s", j, name, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	brokers := r.Brokers()
+	if len(brokers) != 1 || brokers[0].Name != "same" {
+		t.Errorf("registry holds %d brokers after the removals, want only 'same'", len(brokers))
+	}
+}
@@ -0,0 +1,562 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// ---------------------------------------------------------------------------------
+// Replica
+// ---------------------------------------------------------------------------------
+
+// Replica is a single slot of the process pool of a plugin. It runs one plugin process
+// (instance) at a time and manages its life cycle: the process of each replica is
+// started, replaced, restarted and stopped on its own.
+//
+// The status, the port and the address of a replica are guarded by the status lock of
+// its broker; they are read via Snapshot.
+type Replica struct {
+	Index   int           // position of the replica in the pool of the broker
+	port    int           // port of the RPC server of the current plugin process
+	address string        // address (host:port or socket path) of the RPC server of the current plugin process
+	current *instance     // plugin process that serves the calls of the replica
+	pending *instance     // plugin process that is about to replace the current one
+	broker  *PluginBroker // broker the replica belongs to
+	status  PluginStatus  // status of the replica
+	proto   int           // protocol version of the current plugin process
+	caps    []string      // capabilities shared with the current plugin process
+	codec   string        // codec of the current plugin process
+}
+
+// newReplica returns a not yet started replica of the given broker.
+func newReplica(b *PluginBroker, index int) *Replica {
+	s := PluginStatus{
+		State:        None,
+		FailCount:    0,
+		RunCount:     0,
+		RestartCount: 0,
+		ReplaceCount: 0,
+	}
+
+	r := &Replica{
+		Index:  index,
+		port:   0,
+		broker: b,
+		status: s,
+	}
+	return r
+}
+
+// Snapshot returns a consistent copy of the status of the replica.
+func (r *Replica) Snapshot() ReplicaSnapshot {
+	b := r.broker
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+	return r.snapshot()
+}
+
+// snapshot copies the status of the replica. The status lock of the broker needs to
+// be held by the caller.
+func (r *Replica) snapshot() ReplicaSnapshot {
+	s := ReplicaSnapshot{
+		Index:        r.Index,
+		Port:         r.port,
+		Address:      r.address,
+		Protocol:     r.proto,
+		Capabilities: r.caps,
+		Codec:        r.codec,
+		Status:       r.status,
+	}
+	return s
+}
+
+// Spinup maintains the start process of the replica. It returns as soon as the plugin
+// is connected or its process ended before the handshake was completed. A plugin
+// that misses the handshake timeout is killed.
+func (r *Replica) Spinup(orch *Orchestrator) error {
+	b := r.broker
+	if b.isStopping() {
+		return ErrStopping
+	}
+
+	inst, err := r.launch(orch, &r.current)
+	if err != nil {
+		r.fail(err)
+		return err
+	}
+
+	r.setState(Started)
+	go r.watch(inst)
+
+	select {
+	case <-inst.ready:
+		r.update(func(s *PluginStatus) {
+			r.port = inst.port
+			r.address = inst.address
+			r.proto = inst.protocol
+			r.caps = inst.capabilities
+			r.codec = inst.codec
+			s.State = Connected
+		})
+		return nil
+	case <-inst.done:
+		return inst.err
+	case <-time.After(orch.Config.PluginHandshakeTimeout):
+		inst.abort("Handshake missed within " + orch.Config.PluginHandshakeTimeout.String())
+		<-inst.done
+		return inst.err
+	}
+}
+
+// Replace starts a second instance of the plugin, e.g. after its binary was updated,
+// and swaps it in as soon as it completed its handshake. The old instance finishes
+// its in-flight calls and is stopped afterwards, so no call is lost. If the new
+// instance does not connect before the context is done, it is killed and the old
+// instance keeps serving.
+func (r *Replica) Replace(ctx context.Context, orch *Orchestrator) error {
+	b := r.broker
+	b.mu.Lock()
+	if b.stopping {
+		b.mu.Unlock()
+		return ErrStopping
+	}
+	if r.pending != nil {
+		b.mu.Unlock()
+		return errors.New("Plugin is already being replaced")
+	}
+	if r.current == nil || !r.state().IsConnected() {
+		b.mu.Unlock()
+		return errNotConnected
+	}
+	b.mu.Unlock()
+
+	inst, err := r.launch(orch, &r.pending)
+	if err != nil {
+		return r.replaceFailed(err)
+	}
+	go r.watch(inst)
+
+	select {
+	case <-inst.ready:
+	case <-inst.done:
+		b.mu.Lock()
+		r.pending = nil
+		b.mu.Unlock()
+		return r.replaceFailed(inst.err)
+	case <-ctx.Done():
+		b.mu.Lock()
+		r.pending = nil
+		b.mu.Unlock()
+		inst.kill()
+		<-inst.done
+		return r.replaceFailed(errors.New("Handshake missed: " + ctx.Err().Error()))
+	}
+
+	b.mu.Lock()
+	old := r.current
+	r.current = inst
+	r.pending = nil
+	b.mu.Unlock()
+	r.update(func(s *PluginStatus) {
+		r.port = inst.port
+		r.address = inst.address
+		r.proto = inst.protocol
+		r.caps = inst.capabilities
+		r.codec = inst.codec
+		s.ReplaceCount += 1
+	})
+
+	return r.retire(ctx, old)
+}
+
+// Wait blocks until the current plugin process has ended and returns the reason.
+// A process that ended because it was replaced is not considered, Wait keeps
+// waiting for its successor instead.
+func (r *Replica) Wait() error {
+	b := r.broker
+	for {
+		b.mu.Lock()
+		inst := r.current
+		b.mu.Unlock()
+		if inst == nil {
+			return errors.New("Plugin not started")
+		}
+
+		<-inst.done
+
+		b.mu.Lock()
+		replaced := r.current != inst
+		b.mu.Unlock()
+		if !replaced {
+			return inst.err
+		}
+	}
+}
+
+// Stop shuts the replica down gracefully, see PluginBroker.Stop. The broker needs to
+// be marked as stopping beforehand.
+func (r *Replica) Stop(ctx context.Context) error {
+	b := r.broker
+	b.mu.Lock()
+	inst, pending := r.current, r.pending
+	b.mu.Unlock()
+
+	if pending != nil {
+		pending.kill()
+	}
+
+	var err error
+	if inst != nil {
+		err = r.retire(ctx, inst)
+	}
+	r.setState(Stopped)
+	return err
+}
+
+// call invokes the given RPC method of the current plugin process via f. It returns as
+// soon as the context is done; the call stays in-flight until the plugin answers, so
+// the reply must not be used after an error. Until then it keeps its instance and the
+// slot of the call, if any (see Slot). Missed deadlines are recorded in the status.
+func (r *Replica) call(ctx context.Context, method string, f func(c pluginClient) error) error {
+	inst, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	free := holdSlot(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- f(inst.client)
+	}()
+	select {
+	case err = <-done:
+		inst.release()
+		free()
+		if err == nil || ctx.Err() == nil {
+			return err
+		}
+		// the client gave up on its own since the context is done
+	case <-ctx.Done():
+		go func() {
+			<-done
+			inst.release()
+			free()
+		}()
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		return ctx.Err()
+	}
+	msg := method + " timed out after " + time.Since(start).Round(time.Millisecond).String()
+	r.update(func(s *PluginStatus) {
+		s.TimeoutCount += 1
+		s.LastError = msg
+		r.broker.status.LastError = msg
+	})
+	return ErrTimeout
+}
+
+// run invokes the main functionality of the plugin on this replica.
+func (r *Replica) run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	var reply *plugin.Response
+	err := r.call(ctx, "Connector.Run", func(c pluginClient) (err error) {
+		reply, err = c.Run(ctx, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.update(func(s *PluginStatus) {
+		s.RunCount += 1
+	})
+	return reply, nil
+}
+
+// healthCheck pings the plugin and returns the latency of the ping. The check fails if
+// the plugin did not respond within the given timeout.
+func (r *Replica) healthCheck(timeout time.Duration) (time.Duration, error) {
+	inst, err := r.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer inst.release()
+	if !inst.supports(plugin.CapabilityHealth) {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	ping := make(chan error, 1)
+	go func() {
+		_, err := inst.client.Ping(ctx)
+		ping <- err
+	}()
+	select {
+	case err = <-ping:
+		if err == nil || ctx.Err() == nil {
+			return time.Since(start), err
+		}
+	case <-ctx.Done():
+	}
+	return timeout, errors.New("Ping timed out after " + timeout.String())
+}
+
+// abort kills the current plugin process. The given reason is recorded as the cause
+// of the crash; the supervisor restarts the replica afterwards.
+func (r *Replica) abort(reason string) {
+	b := r.broker
+	b.mu.Lock()
+	inst := r.current
+	b.mu.Unlock()
+	if inst != nil {
+		inst.abort(reason)
+	}
+}
+
+// acquire returns the instance of a connected replica and registers an in-flight call
+// on it. The call needs to be released via release() of the instance.
+func (r *Replica) acquire() (*instance, error) {
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopping {
+		return nil, ErrStopping
+	}
+	if r.current == nil || r.current.client == nil || !r.state().IsConnected() {
+		return nil, errNotConnected
+	}
+	r.current.enter()
+	return r.current, nil
+}
+
+// inFlight returns the number of in-flight calls of the current plugin process.
+func (r *Replica) inFlight() int32 {
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.current == nil {
+		return 0
+	}
+	return r.current.calls()
+}
+
+// lookup returns the instance of the plugin process that was given the plugin token,
+// if it belongs to this replica. The broker lock needs to be held by the caller.
+func (r *Replica) lookup(token string) *instance {
+	for _, inst := range []*instance{r.pending, r.current} {
+		if inst == nil {
+			continue
+		}
+		if plugin.EqualTokens(inst.pluginToken, token) {
+			return inst
+		}
+	}
+	return nil
+}
+
+// checksum returns the checksum of the binary the current instance was started from.
+func (r *Replica) checksum() string {
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.current == nil {
+		return ""
+	}
+	return r.current.checksum
+}
+
+// launch starts the plugin binary with its configuration as environment and captures
+// its output in the log buffer of the broker. The new instance is assigned to the
+// given slot of the replica while the process starts, so its token is known as soon
+// as the process connects. The caller needs to watch the instance afterwards.
+func (r *Replica) launch(orch *Orchestrator, slot **instance) (*instance, error) {
+	path := r.broker.Plugin
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, err
+	}
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the tokens are only passed to this very process
+	pluginToken, err := plugin.NewToken()
+	if err != nil {
+		return nil, err
+	}
+	orchToken, err := plugin.NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, r.broker.Args...)
+	cmd.Dir = r.broker.Dir
+	cmd.Env = append(cmd.Env, orch.getEnv(r.broker.config.Env)...)
+	cmd.Env = append(cmd.Env, "PLUGIN_NAME="+r.broker.Name)
+	cmd.Env = append(cmd.Env, "PLUGIN_TOKEN="+pluginToken, "ORCHESTRATOR_TOKEN="+orchToken)
+	if orch.Config.PluginTransport == TransportUnix {
+		cmd.Env = append(cmd.Env, "PLUGIN_SOCKET="+orch.getSocket())
+	}
+	forward := r.broker.config.Logs.Forward
+	stdout := newLogWriter(r.broker, r.Index, Stdout, forward)
+	stderr := newLogWriter(r.broker, r.Index, Stderr, forward)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = sysProcAttr()
+	err = limitCommand(cmd, r.broker.config.Limits)
+	if err != nil {
+		return nil, errors.New("Plugin limits could not be applied: " + err.Error())
+	}
+	inst := newInstance(cmd, checksum, pluginToken, orchToken)
+	inst.stdout = stdout
+	inst.stderr = stderr
+
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	*slot = inst
+	return inst, nil
+}
+
+// retire takes an instance out of service: its in-flight calls are awaited and the
+// process is asked to exit via its Shutdown RPC. Processes that do not support the
+// Shutdown RPC are killed right away. If the process did not exit when the context
+// is done, it is killed.
+func (r *Replica) retire(ctx context.Context, inst *instance) error {
+	b := r.broker
+	b.mu.Lock()
+	inst.retired = true
+	b.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		inst.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+
+	select {
+	case <-inst.done:
+		return nil
+	default:
+	}
+
+	b.mu.Lock()
+	client := inst.client
+	b.mu.Unlock()
+	if client != nil && inst.supports(plugin.CapabilityShutdown) {
+		client.Shutdown()
+	} else {
+		inst.kill()
+	}
+
+	select {
+	case <-inst.done:
+		return nil
+	case <-ctx.Done():
+		inst.kill()
+		<-inst.done
+		return ctx.Err()
+	}
+}
+
+// replaceFailed records a failed replacement and returns the error.
+func (r *Replica) replaceFailed(err error) error {
+	err = errors.New("Replacement failed: " + err.Error())
+	r.update(func(s *PluginStatus) {
+		s.LastError = err.Error()
+		r.broker.status.LastError = err.Error()
+	})
+	return err
+}
+
+// fail makes shure that the state of the replica is reset and the failure is recorded.
+func (r *Replica) fail(err error) {
+	r.update(func(s *PluginStatus) {
+		r.port = 0
+		r.address = ""
+		s.State = None
+		s.FailCount += 1
+		s.LastError = err.Error()
+		r.broker.status.LastError = err.Error()
+	})
+}
+
+// watch keeps track of a plugin process and cleans up if it dies for any reason. Only
+// an unexpected exit of the current instance is considered a failure of the replica.
+func (r *Replica) watch(inst *instance) {
+	err := inst.cmd.Wait()
+	inst.stdout.flush()
+	inst.stderr.flush()
+	if err == nil {
+		err = errors.New("Plugin ended")
+	} else {
+		err = errors.New("Plugin ended: " + err.Error())
+	}
+	if reason := inst.killReason(); reason != "" {
+		err = errors.New("Plugin killed: " + reason)
+	} else if breach := r.broker.config.Limits.breach(inst.cmd.ProcessState); breach != "" {
+		err = errors.New("Plugin killed: " + breach)
+	}
+	inst.err = err
+
+	b := r.broker
+	b.mu.Lock()
+	client := inst.client
+	current := r.current == inst
+	retired := inst.retired
+	b.mu.Unlock()
+	if client != nil {
+		client.Close()
+	}
+
+	if current && retired {
+		r.update(func(s *PluginStatus) {
+			r.port = 0
+			r.address = ""
+			s.State = Stopped
+		})
+		inst.err = ErrStopping
+	} else if current {
+		r.fail(err)
+	}
+	close(inst.done)
+}
+
+// setState sets the state of the replica and updates the state of its broker.
+func (r *Replica) setState(state State) {
+	r.update(func(s *PluginStatus) {
+		s.State = state
+	})
+}
+
+// state returns the current state of the replica.
+func (r *Replica) state() State {
+	b := r.broker
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+	return r.status.State
+}
+
+// update changes the status of the replica under the status lock of the broker and
+// updates the status of the broker afterwards. The given function must not acquire
+// any other lock of the broker.
+func (r *Replica) update(f func(s *PluginStatus)) {
+	b := r.broker
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+	f(&r.status)
+	b.refresh()
+}
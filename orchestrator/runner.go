@@ -0,0 +1,132 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	influxdb "github.com/influxdb/influxdb/client"
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// maxOutput limits the size of the output of a runner, e.g. the stdout of a command.
+const maxOutput = 64 << 20
+
+// maxErrorLength limits the length of an error message taken from the output of a
+// runner, e.g. the stderr of a failed command.
+const maxErrorLength = 1024
+
+// Kinds of plugins. A plugin of KindPlugin is a long-running process that speaks the
+// plugin protocol and is managed by the replicas of its broker. All other kinds have
+// no replicas; their calls are served by a runner.
+const (
+	KindPlugin = "plugin" // process speaking the plugin protocol, the default
+	KindExec   = "exec"   // command run for each request, see execRunner
+	KindHTTP   = "http"   // external HTTP service, see httpRunner
+	KindWasm   = "wasm"   // WebAssembly module run in-process, see wasmRunner
+)
+
+// ---------------------------------------------------------------------------------
+// runner
+// ---------------------------------------------------------------------------------
+
+// runner serves the calls of a broker whose plugin is not a process speaking the
+// plugin protocol. The broker still takes care of timeouts, the circuit breaker, the
+// call queue and the status of the plugin.
+type runner interface {
+	start() error // checks that calls can be served
+	ping(ctx context.Context) (bool, error)
+	describe(ctx context.Context) (*plugin.Description, error)
+	run(ctx context.Context, data plugin.Request) (*plugin.Response, error)
+	stop(ctx context.Context) error // awaits the calls in-flight, aborts them when the context is done
+}
+
+// newRunner returns the runner of the broker for the given kind, nil for KindPlugin.
+func newRunner(b *PluginBroker, kind string) (runner, error) {
+	switch kind {
+	case KindPlugin:
+		return nil, nil
+	case KindExec:
+		return newExecRunner(b), nil
+	case KindHTTP:
+		return newHTTPRunner(b), nil
+	case KindWasm:
+		return newWasmRunner(b), nil
+	default:
+		return nil, errors.New("Unknown kind '" + kind + "' of plugin '" + b.Name + "'. ")
+	}
+}
+
+// startRunner starts the runner of the broker, see Spinup.
+func (b *PluginBroker) startRunner() error {
+	err := b.runner.start()
+	b.updateStatus(func(s *PluginStatus) {
+		if err != nil {
+			s.State = Failed
+			s.FailCount += 1
+			s.LastError = err.Error()
+		} else {
+			s.State = Connected
+		}
+	})
+	return err
+}
+
+// stopRunner stops the runner of the broker, see Stop. The broker needs to be marked
+// as stopping beforehand.
+func (b *PluginBroker) stopRunner(ctx context.Context) error {
+	err := b.runner.stop(ctx)
+	b.updateStatus(func(s *PluginStatus) {
+		s.State = Stopped
+	})
+	return err
+}
+
+// healthCheck pings the runner of the broker and returns the latency, see
+// HealthChecker.CheckRunner.
+func (b *PluginBroker) healthCheck(timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	ok, err := b.runner.ping(ctx)
+	if ctx.Err() != nil {
+		return timeout, errors.New("Ping timed out after " + timeout.String())
+	}
+	if err == nil && !ok {
+		err = errors.New("Ping failed")
+	}
+	return time.Since(start), err
+}
+
+// updateStatus applies f to the status of a broker without replicas.
+func (b *PluginBroker) updateStatus(f func(s *PluginStatus)) {
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+	f(&b.status)
+}
+
+// decodeResponse decodes the JSON output of a runner: a list of series or a response.
+// Numbers keep their literal, so integers stay integers.
+func decodeResponse(out []byte) (*plugin.Response, error) {
+	reply := &plugin.Response{}
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return reply, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(out))
+	d.UseNumber()
+	var err error
+	if out[0] == '[' {
+		var series []*influxdb.Series
+		err = d.Decode(&series)
+		reply.Series = series
+	} else {
+		err = d.Decode(reply)
+	}
+	if err != nil {
+		return nil, errors.New("Invalid output of plugin: " + err.Error())
+	}
+	return reply, nil
+}
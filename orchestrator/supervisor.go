@@ -0,0 +1,85 @@
+package orchestrator
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------
+// Supervisor
+// ---------------------------------------------------------------------------------
+
+// Supervisor keeps the plugins of an orchestrator alive. As soon as a plugin process
+// ends, the supervisor respawns it via PluginBroker.Spinup. Restarts are delayed by an
+// exponentially growing backoff with jitter. A plugin that crashes more often in a row
+// than the crash budget allows is given up and marked as Failed. Each replica of a
+// plugin is supervised on its own.
+type Supervisor struct {
+	orch *Orchestrator
+}
+
+// NewSupervisor returns a supervisor for the plugins of the given orchestrator.
+func NewSupervisor(orch *Orchestrator) *Supervisor {
+	s := &Supervisor{
+		orch: orch,
+	}
+	return s
+}
+
+// Supervise watches the process of the given replica and restarts it whenever it ends.
+// It returns as soon as the crash budget of the replica is used up or the plugin is
+// stopped. A replica that has been connected for at least PluginBackoffMax is
+// considered stable and gets its crash budget renewed.
+func (s *Supervisor) Supervise(r *Replica) {
+	conf := s.orch.Config
+	crashes := 0
+	for {
+		if r.state().IsConnected() {
+			connected := time.Now()
+			r.Wait()
+			if time.Since(connected) >= conf.PluginBackoffMax {
+				crashes = 0
+			}
+		}
+
+		if r.broker.isStopping() {
+			return
+		}
+
+		crashes++
+		if crashes > conf.PluginMaxRestarts {
+			r.setState(Failed)
+			return
+		}
+
+		r.setState(Backoff)
+		time.Sleep(s.backoff(crashes))
+		if r.broker.isStopping() {
+			r.setState(Stopped)
+			return
+		}
+
+		r.update(func(s *PluginStatus) {
+			s.RestartCount += 1
+		})
+		r.Spinup(s.orch)
+	}
+}
+
+// backoff returns the delay before the given restart attempt. The delay doubles with
+// every attempt, starting at PluginBackoffMin and capped at PluginBackoffMax. Half of
+// the delay is randomized so crashing plugins do not restart in lockstep.
+func (s *Supervisor) backoff(attempt int) time.Duration {
+	conf := s.orch.Config
+	d := conf.PluginBackoffMin
+	for i := 1; i < attempt && d < conf.PluginBackoffMax; i++ {
+		d *= 2
+	}
+	if d > conf.PluginBackoffMax {
+		d = conf.PluginBackoffMax
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
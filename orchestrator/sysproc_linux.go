@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package orchestrator
+
+import (
+	"syscall"
+)
+
+// sysProcAttr returns the process attributes of a plugin. On Linux, the plugin gets
+// killed by the kernel as soon as the orchestrator dies, so it can never outlive it.
+// Plugins that drop to another user and group do so via limitCommand.
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package orchestrator
+
+import (
+	"syscall"
+)
+
+// sysProcAttr returns the process attributes of a plugin. Parent-death signals are
+// only supported on Linux; elsewhere plugins notice a vanished orchestrator by
+// their ping.
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,73 @@
+// Command sampleplugin is the plugin the tests run against a real orchestrator. Its Run
+// call is controlled by the query of the request:
+//
+//	sleep=<duration>  waits before answering
+//	crash=1           exits without answering
+//	fail=<message>    answers with the message as error
+//	points=<n>        answers with a series "points" of n points and a series "end"
+//
+// Otherwise it answers with a series "sample" holding its pid. The codec is chosen by
+// the -codec flag.
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"time"
+
+	influxdb "github.com/influxdb/influxdb/client"
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+type sample struct{}
+
+func (sample) Describe() plugin.Description {
+	return plugin.Description{
+		Description: "Sample plugin of the tests",
+		Arguments: []plugin.Argument{
+			{Name: "sleep", Description: "time to wait before answering", Optional: true},
+			{Name: "crash", Description: "exit without answering", Optional: true},
+			{Name: "fail", Description: "error message to answer with", Optional: true},
+			{Name: "points", Description: "number of points to answer with", Optional: true},
+		},
+	}
+}
+
+func (sample) Run(in plugin.Request) plugin.Response {
+	if d, err := time.ParseDuration(in.Query.Get("sleep")); err == nil {
+		time.Sleep(d)
+	}
+	if in.Query.Get("crash") != "" {
+		os.Exit(3)
+	}
+	if msg := in.Query.Get("fail"); msg != "" {
+		return plugin.Response{Error: msg}
+	}
+	if n, err := strconv.Atoi(in.Query.Get("points")); err == nil {
+		s := &influxdb.Series{Name: "points", Columns: []string{"index", "value"}}
+		for i := 0; i < n; i++ {
+			s.Points = append(s.Points, []interface{}{strconv.Itoa(i), float64(i) / 2})
+		}
+		end := &influxdb.Series{Name: "end", Columns: []string{"index"}, Points: [][]interface{}{{strconv.Itoa(n)}}}
+		return plugin.Response{Series: []*influxdb.Series{s, end}}
+	}
+	s := &influxdb.Series{
+		Name:    "sample",
+		Columns: []string{"pid"},
+		Points:  [][]interface{}{{os.Getpid()}},
+	}
+	return plugin.Response{Series: []*influxdb.Series{s}}
+}
+
+func main() {
+	codec := flag.String("codec", plugin.CodecGob, "codec of the RPC connections")
+	flag.Parse()
+
+	p, err := plugin.NewPlugin()
+	if err != nil {
+		panic(err)
+	}
+	p.Config.Codec = *codec
+	p.Run(sample{})
+}
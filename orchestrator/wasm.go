@@ -0,0 +1,430 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxproxy/influxproxy/plugin"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// wasmPageSize is the size of a page of WebAssembly memory.
+const wasmPageSize = 64 * 1024
+
+// wasmCache keeps the compiled code of the modules, so plugins that share a module or
+// are added again do not compile it again.
+var wasmCache = wazero.NewCompilationCache()
+
+// Functions exported by WebAssembly plugins, see wasmRunner.
+const (
+	wasmAlloc    = "alloc"
+	wasmRun      = "run"
+	wasmDescribe = "describe"
+)
+
+// ---------------------------------------------------------------------------------
+// wasmRunner
+// ---------------------------------------------------------------------------------
+
+// wasmRunner serves the calls of a plugin of KindWasm: a WebAssembly module that is
+// run in-process by a pure Go runtime. Every call gets a new instance of the module,
+// so calls neither share memory nor outlive a crash. The module has no access to the
+// host besides WASI stdout and stderr, which are captured in the log buffer of the
+// broker, the clocks and a random source.
+//
+// The module exports its memory and the functions
+//
+//	alloc(size i32) i32             reserves size bytes for the input and returns their address
+//	run(ptr i32, size i32) i64      takes the request as JSON, returns the response as JSON
+//	describe() i64                  returns the description as JSON, optional
+//
+// The request and the response are encoded like the argument and the result of
+// Connector.Run of the jsonrpc codec; the response may be a list of series as well.
+// Results of i64 hold the address of the output in the upper and its size in the
+// lower 32 bits. Each instance is limited to WasmConfiguration.MaxMemory bytes of
+// memory and WasmConfiguration.Fuel function calls.
+type wasmRunner struct {
+	broker   *PluginBroker
+	mu       sync.Mutex
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule // module of the plugin, compiled by start
+	wg       sync.WaitGroup        // calls in-flight
+	abort    context.Context       // done as soon as the calls in-flight are aborted by stop
+	cancel   context.CancelFunc    // aborts the calls in-flight
+}
+
+// newWasmRunner returns the runner of a WebAssembly plugin.
+func newWasmRunner(b *PluginBroker) *wasmRunner {
+	w := &wasmRunner{
+		broker: b,
+	}
+	w.abort, w.cancel = context.WithCancel(context.Background())
+	return w
+}
+
+// start implements runner by compiling the module and checking its exports.
+func (w *wasmRunner) start() error {
+	code, err := os.ReadFile(w.broker.Plugin)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conf := w.broker.config.Wasm
+	rc := wazero.NewRuntimeConfig().WithCloseOnContextDone(true).WithCompilationCache(wasmCache)
+	if conf.Fuel > 0 {
+		ctx = experimental.WithFunctionListenerFactory(ctx, experimental.FunctionListenerFactoryFunc(
+			func(api.FunctionDefinition) experimental.FunctionListener {
+				return experimental.FunctionListenerFunc(burnFuel)
+			}))
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, rc)
+	_, err = wasi_snapshot_preview1.Instantiate(ctx, rt)
+	if err == nil {
+		err = w.load(ctx, rt, code)
+	}
+	if err != nil {
+		rt.Close(ctx)
+		return err
+	}
+	return nil
+}
+
+// wasmPages returns the number of pages of WebAssembly memory that hold the given
+// number of bytes, at least one.
+func wasmPages(bytes uint64) uint32 {
+	pages := (bytes + wasmPageSize - 1) / wasmPageSize
+	if pages < 1 {
+		return 1
+	}
+	if pages > 1<<16 {
+		return 1 << 16
+	}
+	return uint32(pages)
+}
+
+// load compiles the module with the runtime and keeps both.
+func (w *wasmRunner) load(ctx context.Context, rt wazero.Runtime, code []byte) error {
+	compiled, err := rt.CompileModule(ctx, code)
+	if err != nil {
+		return errors.New("Invalid WebAssembly module '" + w.broker.Plugin + "': " + err.Error())
+	}
+	memory, ok := compiled.ExportedMemories()["memory"]
+	if !ok {
+		return errors.New("WebAssembly module '" + w.broker.Plugin + "' does not export its memory")
+	}
+	if max := w.broker.config.Wasm.MaxMemory; max > 0 && memory.Min() > wasmPages(max) {
+		return errors.New("WebAssembly module '" + w.broker.Plugin + "' needs more memory than the limit of " + strconv.FormatUint(max, 10) + " bytes")
+	}
+	for _, name := range []string{wasmAlloc, wasmRun} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			return errors.New("WebAssembly module '" + w.broker.Plugin + "' does not export '" + name + "'")
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.runtime, w.compiled = rt, compiled
+	return nil
+}
+
+// ping implements runner. Modules are only instantiated on demand, so there is
+// nothing to ping.
+func (w *wasmRunner) ping(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+// describe implements runner by calling describe of the module, if it exports it.
+func (w *wasmRunner) describe(ctx context.Context) (*plugin.Description, error) {
+	w.mu.Lock()
+	compiled := w.compiled
+	w.mu.Unlock()
+	if compiled == nil {
+		return nil, errNotConnected
+	}
+	if _, ok := compiled.ExportedFunctions()[wasmDescribe]; !ok {
+		d := &plugin.Description{
+			Description: "WebAssembly module " + w.broker.Plugin,
+		}
+		return d, nil
+	}
+
+	out, err := w.call(ctx, wasmDescribe, nil)
+	if err != nil {
+		return nil, err
+	}
+	d := &plugin.Description{}
+	err = json.Unmarshal(out, d)
+	if err != nil {
+		return nil, errors.New("Invalid description of plugin: " + err.Error())
+	}
+	return d, nil
+}
+
+// run implements runner by calling run of a new instance of the module.
+func (w *wasmRunner) run(ctx context.Context, data plugin.Request) (*plugin.Response, error) {
+	b := w.broker
+	if !b.State().IsConnected() {
+		return nil, errNotConnected
+	}
+	in, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	out, err := w.call(ctx, wasmRun, in)
+	if ctx.Err() != nil {
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		msg := "Module timed out after " + time.Since(start).Round(time.Millisecond).String()
+		b.updateStatus(func(s *PluginStatus) {
+			s.TimeoutCount += 1
+			s.LastError = msg
+		})
+		return nil, ErrTimeout
+	}
+	if err == nil {
+		var reply *plugin.Response
+		reply, err = decodeResponse(out)
+		if err == nil {
+			b.updateStatus(func(s *PluginStatus) {
+				s.RunCount += 1
+			})
+			return reply, nil
+		}
+	}
+	b.updateStatus(func(s *PluginStatus) {
+		s.FailCount += 1
+		s.LastError = err.Error()
+	})
+	return nil, err
+}
+
+// call instantiates the module, calls the given function with the input and returns
+// a copy of its output. Without input, the function is called without arguments.
+func (w *wasmRunner) call(ctx context.Context, function string, in []byte) ([]byte, error) {
+	b := w.broker
+	w.mu.Lock()
+	if b.isStopping() {
+		w.mu.Unlock()
+		return nil, ErrStopping
+	}
+	rt, compiled := w.runtime, w.compiled
+	w.wg.Add(1)
+	w.mu.Unlock()
+	defer w.wg.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(w.abort, cancel)()
+	tank := &fuelTank{left: int64(b.config.Wasm.Fuel), cancel: cancel}
+	ctx = context.WithValue(ctx, fuelKey{}, tank)
+
+	stdout := newLogWriter(b, 0, Stdout, b.config.Logs.Forward)
+	stderr := newLogWriter(b, 0, Stderr, b.config.Logs.Forward)
+	defer stdout.flush()
+	defer stderr.flush()
+	mc := wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+
+	conf := b.config.Wasm
+	var memory *wasmMemory
+	if conf.MaxMemory > 0 {
+		ctx = experimental.WithMemoryAllocator(ctx, experimental.MemoryAllocatorFunc(
+			func(capacity, _ uint64) experimental.LinearMemory {
+				memory = newWasmMemory(capacity, uint64(wasmPages(conf.MaxMemory))*wasmPageSize)
+				return memory
+			}))
+	}
+
+	out, err := w.instantiate(ctx, rt, compiled, mc, function, in)
+	if err != nil && ctx.Err() == nil || tank.empty {
+		switch {
+		case tank.empty:
+			err = errors.New("Module killed: fuel of " + strconv.FormatUint(conf.Fuel, 10) + " calls exhausted")
+		case memory != nil && memory.exceeded:
+			err = errors.New("Module killed: memory limit of " + strconv.FormatUint(conf.MaxMemory, 10) + " bytes exceeded")
+		}
+	}
+	return out, err
+}
+
+// instantiate runs a single call on a new instance of the module.
+func (w *wasmRunner) instantiate(ctx context.Context, rt wazero.Runtime, compiled wazero.CompiledModule, mc wazero.ModuleConfig, function string, in []byte) ([]byte, error) {
+	mod, err := rt.InstantiateModule(ctx, compiled, mc)
+	if err != nil {
+		return nil, wasmError(err)
+	}
+	defer mod.Close(context.Background())
+
+	var params []uint64
+	if in != nil {
+		res, err := mod.ExportedFunction(wasmAlloc).Call(ctx, uint64(len(in)))
+		if err != nil {
+			return nil, wasmError(err)
+		}
+		ptr := uint32(res[0])
+		if !mod.Memory().Write(ptr, in) {
+			return nil, errors.New("Module allocated no memory for the input")
+		}
+		params = []uint64{uint64(ptr), uint64(len(in))}
+	}
+	res, err := mod.ExportedFunction(function).Call(ctx, params...)
+	if err != nil {
+		return nil, wasmError(err)
+	}
+
+	ptr, size := uint32(res[0]>>32), uint32(res[0])
+	if size > maxOutput {
+		return nil, errors.New("Module answered with more than " + strconv.Itoa(maxOutput) + " bytes")
+	}
+	out, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return nil, errors.New("Module answered with an output outside of its memory")
+	}
+	return append([]byte(nil), out...), nil
+}
+
+// stop implements runner. Instances still running when the context is done are
+// closed.
+func (w *wasmRunner) stop(ctx context.Context) error {
+	w.mu.Lock() // no call starts once the broker is stopping
+	w.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		w.cancel()
+		<-done
+		err = ctx.Err()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.runtime != nil {
+		w.runtime.Close(context.Background())
+	}
+	return err
+}
+
+// wasmError returns the error of a failed call of a module, without the stack trace
+// of traps.
+func wasmError(err error) error {
+	var exit *sys.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() < sys.ExitCodeDeadlineExceeded {
+		return errors.New("Module exited with status " + strconv.FormatUint(uint64(exit.ExitCode()), 10))
+	}
+	msg, _, _ := strings.Cut(err.Error(), "\n")
+	return errors.New("Module failed: " + msg)
+}
+
+// ---------------------------------------------------------------------------------
+// wasmMemory
+// ---------------------------------------------------------------------------------
+
+// wasmMemory backs the memory of an instance of a module and limits it to max bytes.
+// Growing it beyond the limit fails like growing it beyond the maximum the module
+// declares, which most modules answer with a trap or an exit; the failure is recorded,
+// so that the call is reported as killed by the limit.
+type wasmMemory struct {
+	buf      []byte
+	max      uint64
+	exceeded bool // set as soon as the module failed to grow its memory beyond max
+}
+
+// newWasmMemory returns the memory of an instance with the suggested capacity.
+func newWasmMemory(capacity uint64, max uint64) *wasmMemory {
+	if capacity > max {
+		capacity = max
+	}
+	m := &wasmMemory{
+		buf: make([]byte, 0, capacity),
+		max: max,
+	}
+	return m
+}
+
+// Reallocate implements experimental.LinearMemory. It returns nil if the size exceeds
+// the limit.
+func (m *wasmMemory) Reallocate(size uint64) []byte {
+	if size > m.max {
+		m.exceeded = true
+		return nil
+	}
+	if size > uint64(cap(m.buf)) {
+		buf := make([]byte, size, min(max(size, 2*uint64(cap(m.buf))), m.max))
+		copy(buf, m.buf)
+		m.buf = buf
+	} else {
+		m.buf = m.buf[:size]
+	}
+	return m.buf
+}
+
+// Free implements experimental.LinearMemory.
+func (m *wasmMemory) Free() {
+	m.buf = nil
+}
+
+// ---------------------------------------------------------------------------------
+// fuelTank
+// ---------------------------------------------------------------------------------
+
+// fuelKey is the key of the fuelTank of a call in its context.
+type fuelKey struct{}
+
+// fuelTank holds the fuel left to a call of a WebAssembly module. Every function
+// call of the module burns one unit; the call is cancelled as soon as the tank is
+// empty. Loops without function calls are only bound by the timeout of the call.
+type fuelTank struct {
+	left   int64
+	empty  bool // set as soon as the call ran out of fuel
+	cancel context.CancelFunc
+}
+
+// burnFuel is called before each function call of a module.
+func burnFuel(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	tank, ok := ctx.Value(fuelKey{}).(*fuelTank)
+	if !ok || tank.empty {
+		return
+	}
+	tank.left--
+	if tank.left < 0 {
+		tank.empty = true
+		tank.cancel()
+	}
+}
+
+// ---------------------------------------------------------------------------------
+// WasmConfiguration
+// ---------------------------------------------------------------------------------
+
+// WasmConfiguration describes the limits of each call of a WebAssembly plugin.
+type WasmConfiguration struct {
+	MaxMemory uint64 // memory of an instance in bytes, rounded up to pages of 64 KiB, 0 means 4 GiB
+	Fuel      uint64 // function calls of a call, 0 means unlimited
+}
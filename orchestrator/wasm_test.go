@@ -0,0 +1,41 @@
+package orchestrator
+
+import "testing"
+
+func TestWasmPages(t *testing.T) {
+	tests := []struct {
+		bytes uint64
+		pages uint32
+	}{
+		{1, 1},
+		{wasmPageSize - 1, 1},
+		{wasmPageSize, 1},
+		{wasmPageSize + 1, 2},
+		{64 << 20, 1024},
+		{1 << 40, 1 << 16},
+	}
+	for _, tt := range tests {
+		if got := wasmPages(tt.bytes); got != tt.pages {
+			t.Errorf("wasmPages(%d) = %d, want %d", tt.bytes, got, tt.pages)
+		}
+	}
+}
+
+func TestWasmMemory(t *testing.T) {
+	m := newWasmMemory(wasmPageSize, 4*wasmPageSize)
+	buf := m.Reallocate(wasmPageSize)
+	if len(buf) != wasmPageSize {
+		t.Fatalf("Reallocate() returned %d bytes, want %d", len(buf), wasmPageSize)
+	}
+	buf[0] = 42
+	buf = m.Reallocate(3 * wasmPageSize)
+	if len(buf) != 3*wasmPageSize || buf[0] != 42 {
+		t.Fatalf("Reallocate() did not keep the memory while growing it")
+	}
+	if m.exceeded {
+		t.Errorf("memory within the limit is reported as exceeded")
+	}
+	if buf := m.Reallocate(5 * wasmPageSize); buf != nil || !m.exceeded {
+		t.Errorf("Reallocate() beyond the limit returned %d bytes, exceeded = %t", len(buf), m.exceeded)
+	}
+}
@@ -0,0 +1,55 @@
+package orchestrator
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------
+// Watcher
+// ---------------------------------------------------------------------------------
+
+// Watcher keeps an eye on the binaries of the plugins. As soon as the binary of a
+// connected plugin changed on disk, the plugin is replaced without downtime.
+type Watcher struct {
+	orch *Orchestrator
+}
+
+// NewWatcher returns a watcher for the plugins of the given orchestrator.
+func NewWatcher(orch *Orchestrator) *Watcher {
+	w := &Watcher{
+		orch: orch,
+	}
+	return w
+}
+
+// Watch checks the binary of the given broker every PluginWatchInterval until the
+// plugin is stopped. The modification time is used to detect candidates, but the
+// plugin is only replaced if the checksum of the binary changed as well.
+func (w *Watcher) Watch(b *PluginBroker) {
+	conf := w.orch.Config
+	if conf.PluginWatchInterval <= 0 {
+		return
+	}
+
+	var modTime time.Time
+	for !b.isStopping() {
+		time.Sleep(conf.PluginWatchInterval)
+
+		info, err := os.Stat(b.Plugin)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+
+		checksum, err := fileChecksum(b.Plugin)
+		if err != nil || !b.outdated(checksum) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), conf.PluginReplaceTimeout)
+		b.Replace(ctx, w.orch)
+		cancel()
+	}
+}
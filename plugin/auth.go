@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+)
+
+// AuthTimeout limits the time the exchange of the tokens on a new connection may take.
+const AuthTimeout = 10 * time.Second
+
+// maxTokenLength limits the size of a token read from a connection.
+const maxTokenLength = 128
+
+// ---------------------------------------------------------------------------------
+// Authentication
+// ---------------------------------------------------------------------------------
+
+// The orchestrator generates two random tokens for every plugin process it launches
+// and passes them only to the environment of that process: the plugin token proves
+// the identity of the plugin, the orchestrator token proves the identity of the
+// orchestrator. Before any RPC traffic flows over a new connection, the dialing side
+// sends its own token and the accepting side answers with its own token. Both sides
+// close the connection as soon as they receive a token they do not expect. Each token
+// is sent as a single line; the dialing side appends the codec of the connection to
+// its token, separated by a space, unless it is CodecGob.
+
+// NewToken returns a new random token.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SendToken writes the token to the connection.
+func SendToken(conn net.Conn, token string) error {
+	_, err := conn.Write([]byte(token + "\n"))
+	return err
+}
+
+// ReceiveToken reads a token from the connection. The connection is read byte by
+// byte, so no RPC data following the token is consumed.
+func ReceiveToken(conn net.Conn) (string, error) {
+	var token []byte
+	b := make([]byte, 1)
+	for len(token) <= maxTokenLength {
+		_, err := conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(token), nil
+		}
+		token = append(token, b[0])
+	}
+	return "", errors.New("Token too long")
+}
+
+// EqualTokens compares two tokens in constant time.
+func EqualTokens(a string, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// DialAuthenticated connects to the given address, sends the own token along with the
+// codec of the connection and checks the token of the peer.
+func DialAuthenticated(network string, address string, own string, peer string, codec string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, AuthTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(AuthTimeout))
+	err = SendToken(conn, formatHello(own, codec))
+	if err == nil {
+		var token string
+		token, err = ReceiveToken(conn)
+		if err == nil && !EqualTokens(peer, token) {
+			err = errors.New("Peer presented an invalid token")
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// acceptAuthenticated checks the token of a dialing peer and answers with the own token.
+// The peer needs to speak the given codec.
+func acceptAuthenticated(conn net.Conn, own string, peer string, codec string) error {
+	conn.SetDeadline(time.Now().Add(AuthTimeout))
+	hello, err := ReceiveToken(conn)
+	if err != nil {
+		return err
+	}
+	token, peerCodec := ParseHello(hello)
+	if !EqualTokens(peer, token) {
+		return errors.New("Peer presented an invalid token")
+	}
+	if peerCodec != codec {
+		return errors.New("Peer speaks codec '" + peerCodec + "' instead of '" + codec + "'")
+	}
+	err = SendToken(conn, own)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// accept runs acceptAuthenticated on the next connection of the listener and delivers
+// its outcome.
+func accept(t *testing.T, ln net.Listener, own string, peer string, codec string) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		err = acceptAuthenticated(conn, own, peer, codec)
+		conn.Close()
+		done <- err
+	}()
+	return done
+}
+
+func TestAuthentication(t *testing.T) {
+	const (
+		dialer   = "dialer-token"
+		acceptor = "acceptor-token"
+	)
+	tests := []struct {
+		name       string
+		dialerOwn  string // token the dialing side sends
+		dialerPeer string // token the dialing side expects
+		dialCodec  string // codec the dialing side names
+		codec      string // codec the accepting side expects
+		acceptErr  string // error of the accepting side
+		dialErr    bool   // the dialing side fails
+	}{
+		{
+			name:      "gob",
+			dialerOwn: dialer, dialerPeer: acceptor,
+			dialCodec: CodecGob, codec: CodecGob,
+		},
+		{
+			name:      "jsonrpc",
+			dialerOwn: dialer, dialerPeer: acceptor,
+			dialCodec: CodecJSON, codec: CodecJSON,
+		},
+		{
+			name:      "wrong token of the dialing side",
+			dialerOwn: "forged", dialerPeer: acceptor,
+			dialCodec: CodecGob, codec: CodecGob,
+			acceptErr: "invalid token",
+			dialErr:   true,
+		},
+		{
+			name:      "wrong token of the accepting side",
+			dialerOwn: dialer, dialerPeer: "expected",
+			dialCodec: CodecGob, codec: CodecGob,
+			dialErr: true,
+		},
+		{
+			name:      "missing codec",
+			dialerOwn: dialer, dialerPeer: acceptor,
+			dialCodec: "", codec: CodecJSON,
+			acceptErr: "instead of 'jsonrpc'",
+			dialErr:   true,
+		},
+		{
+			name:      "other codec",
+			dialerOwn: dialer, dialerPeer: acceptor,
+			dialCodec: CodecJSON, codec: CodecGob,
+			acceptErr: "instead of 'gob'",
+			dialErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			accepted := accept(t, ln, acceptor, dialer, tt.codec)
+
+			conn, err := DialAuthenticated("tcp", ln.Addr().String(), tt.dialerOwn, tt.dialerPeer, tt.dialCodec)
+			if conn != nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.dialErr {
+				t.Errorf("DialAuthenticated() error = %v, want error %t", err, tt.dialErr)
+			}
+			err = <-accepted
+			switch {
+			case tt.acceptErr == "" && err != nil:
+				t.Errorf("acceptAuthenticated() failed: %s", err)
+			case tt.acceptErr != "" && (err == nil || !strings.Contains(err.Error(), tt.acceptErr)):
+				t.Errorf("acceptAuthenticated() error = %v, want %q", err, tt.acceptErr)
+			}
+		})
+	}
+}
+
+func TestParseHello(t *testing.T) {
+	tests := []struct {
+		line  string
+		token string
+		codec string
+	}{
+		{"abc", "abc", CodecGob},
+		{"abc jsonrpc", "abc", CodecJSON},
+		{"abc grpc ", "abc", CodecGRPC},
+		{"", "", CodecGob},
+	}
+	for _, tt := range tests {
+		token, codec := ParseHello(tt.line)
+		if token != tt.token || codec != tt.codec {
+			t.Errorf("ParseHello(%q) = %q, %q, want %q, %q", tt.line, token, codec, tt.token, tt.codec)
+		}
+		if tt.codec != CodecGob {
+			if hello := formatHello(tt.token, tt.codec); hello != strings.TrimSpace(tt.line) {
+				t.Errorf("formatHello(%q, %q) = %q, want %q", tt.token, tt.codec, hello, tt.line)
+			}
+		}
+	}
+}
+
+func TestReceiveTokenTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte(strings.Repeat("a", maxTokenLength+10) + "\n"))
+
+	_, err := ReceiveToken(server)
+	if err == nil {
+		t.Fatal("ReceiveToken() accepted a token that is too long")
+	}
+}
+
+func TestEqualTokens(t *testing.T) {
+	if EqualTokens("", "") {
+		t.Error("empty tokens are equal")
+	}
+	if !EqualTokens("abc", "abc") || EqualTokens("abc", "abd") {
+		t.Error("EqualTokens() does not compare the tokens")
+	}
+}
@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+)
+
+// Codecs encode the RPC traffic between the orchestrator and a plugin. The codec of a
+// connection is named by the dialing side together with its token (see
+// Authentication), peers that name no codec speak CodecGob.
+const (
+	CodecGob  = "gob"     // encoding/gob as used by net/rpc, requires plugins written in Go
+	CodecJSON = "jsonrpc" // JSON-RPC 1.0 as used by net/rpc/jsonrpc, see PROTOCOL.md
+	CodecGRPC = "grpc"    // gRPC with the services of pluginpb/plugin.proto
+)
+
+// Codecs lists the codecs implemented by this package.
+var Codecs = []string{CodecGob, CodecJSON, CodecGRPC}
+
+// SupportsCodec reports whether the codec is in the list. Peers that did not state
+// their codecs (nil) only speak CodecGob.
+func SupportsCodec(codecs []string, codec string) bool {
+	if codecs == nil {
+		codecs = []string{CodecGob}
+	}
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClient returns an RPC client that speaks the given codec on the connection.
+func NewClient(codec string, conn io.ReadWriteCloser) *rpc.Client {
+	if codec == CodecJSON {
+		return jsonrpc.NewClient(conn)
+	}
+	return rpc.NewClient(conn)
+}
+
+// ServeConn serves the RPC functionality registered with net/rpc on the connection,
+// using the given codec. Connections of CodecGRPC are served by a gRPC server instead.
+func ServeConn(codec string, conn io.ReadWriteCloser) {
+	if codec == CodecJSON {
+		jsonrpc.ServeConn(conn)
+		return
+	}
+	rpc.ServeConn(conn)
+}
+
+// formatHello returns the line the dialing side of a connection sends: its token,
+// followed by the codec of the connection unless it is CodecGob.
+func formatHello(token string, codec string) string {
+	if codec == "" || codec == CodecGob {
+		return token
+	}
+	return token + " " + codec
+}
+
+// ParseHello splits the line received from the dialing side of a connection into the
+// token and the codec of the connection.
+func ParseHello(line string) (string, string) {
+	token := line
+	codec := CodecGob
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		token, codec = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	return token, codec
+}
@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"errors"
+	"net/http"
 	"net/url"
 
 	influxdb "github.com/influxdb/influxdb/client"
@@ -14,7 +15,8 @@ import (
 // Connector provides all functionality that is exposed via RPC to recieve messages from
 // the orchestrator.
 type Connector struct {
-	e Exposer
+	e    Exposer
+	quit chan bool // receives a value as soon as the orchestrator asks the plugin to exit
 }
 
 // NewConnector returns a fully initialiyed Connector. It requires anything that implements
@@ -48,6 +50,23 @@ func (c *Connector) Run(in Request, out *Response) error {
 	return nil
 }
 
+// Shutdown is called by the orchestrator when it stops the plugin. If the Exposer
+// implements the Shutdowner interface, it gets the chance to clean up before the
+// plugin exits.
+func (c *Connector) Shutdown(in []*interface{}, ok *bool) error {
+	if s, isShutdowner := c.e.(Shutdowner); isShutdowner {
+		s.Shutdown()
+	}
+	*ok = true
+	if c.quit != nil {
+		// exit after the reply has been sent
+		go func() {
+			c.quit <- true
+		}()
+	}
+	return nil
+}
+
 // ---------------------------------------------------------------------------------
 // Exposer
 // ---------------------------------------------------------------------------------
@@ -63,6 +82,12 @@ type Exposer interface {
 	Run(in Request) Response
 }
 
+// Shutdowner can optionally be implemented by an Exposer that needs to release
+// resources before the plugin exits on request of the orchestrator.
+type Shutdowner interface {
+	Shutdown()
+}
+
 // ---------------------------------------------------------------------------------
 // Request
 // ---------------------------------------------------------------------------------
@@ -72,8 +97,9 @@ type Exposer interface {
 // Since this is specific to InfluxProxy, this needs to be changed on case of
 // alternative use in other projects.
 type Request struct {
-	Query url.Values
-	Body  []byte
+	Query  url.Values
+	Body   []byte
+	Header http.Header // header of the HTTP request, without hop-by-hop and credential fields
 }
 
 // ---------------------------------------------------------------------------------
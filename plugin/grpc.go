@@ -0,0 +1,389 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	influxdb "github.com/influxdb/influxdb/client"
+	"github.com/influxproxy/influxproxy/plugin/pluginpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// maxStreamPoints limits the number of points sent in a single message of RunStream.
+const maxStreamPoints = 10000
+
+// ---------------------------------------------------------------------------------
+// ConnListener
+// ---------------------------------------------------------------------------------
+
+// ConnListener is a net.Listener that accepts the connections handed over by Put. It
+// lets a gRPC server serve connections that were accepted and authenticated elsewhere.
+type ConnListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewConnListener returns a listener for connections accepted on the given address.
+func NewConnListener(addr net.Addr) *ConnListener {
+	l := &ConnListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	return l
+}
+
+// Put hands the connection over to the server accepting on the listener. The
+// connection is closed if the listener is closed.
+func (l *ConnListener) Put(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept implements net.Listener.
+func (l *ConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+// Close implements net.Listener.
+func (l *ConnListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *ConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// DialGRPC returns a gRPC client of the given address. Each connection of the client
+// presents the own token and checks the token of the peer, see DialAuthenticated.
+func DialGRPC(network string, address string, own string, peer string) (*grpc.ClientConn, error) {
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return DialAuthenticated(network, addr, own, peer, CodecGRPC)
+	}
+	return grpc.NewClient("passthrough:///"+address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+		grpc.WithAuthority("localhost"),
+	)
+}
+
+// ---------------------------------------------------------------------------------
+// grpcConnector
+// ---------------------------------------------------------------------------------
+
+// grpcConnector exposes the functionality of the Connector via gRPC.
+type grpcConnector struct {
+	pluginpb.UnimplementedPluginServer
+	c *Connector
+}
+
+// Ping implements pluginpb.PluginServer.
+func (g *grpcConnector) Ping(ctx context.Context, in *pluginpb.Empty) (*pluginpb.PingReply, error) {
+	var pong bool
+	err := g.c.Ping(nil, &pong)
+	return &pluginpb.PingReply{Pong: pong}, err
+}
+
+// Describe implements pluginpb.PluginServer.
+func (g *grpcConnector) Describe(ctx context.Context, in *pluginpb.Empty) (*pluginpb.Description, error) {
+	var description Description
+	err := g.c.Describe(nil, &description)
+	return description.Proto(), err
+}
+
+// Run implements pluginpb.PluginServer.
+func (g *grpcConnector) Run(ctx context.Context, in *pluginpb.Request) (*pluginpb.Response, error) {
+	var out Response
+	err := g.c.Run(RequestFromProto(in), &out)
+	return out.Proto(), err
+}
+
+// RunStream implements pluginpb.PluginServer. The series of the response are sent in
+// chunks of at most maxStreamPoints points, the error with the last chunk.
+func (g *grpcConnector) RunStream(in *pluginpb.Request, stream pluginpb.Plugin_RunStreamServer) error {
+	var out Response
+	err := g.c.Run(RequestFromProto(in), &out)
+	if err != nil {
+		return err
+	}
+	chunk := &pluginpb.Response{}
+	points := 0
+	for _, s := range out.Series {
+		if s == nil {
+			continue
+		}
+		for start := 0; start == 0 || start < len(s.Points); start += maxStreamPoints {
+			end := start + maxStreamPoints
+			if end > len(s.Points) {
+				end = len(s.Points)
+			}
+			part := &influxdb.Series{Name: s.Name, Columns: s.Columns, Points: s.Points[start:end]}
+			if points > 0 && points+len(part.Points) > maxStreamPoints {
+				err = stream.Send(chunk)
+				if err != nil {
+					return err
+				}
+				chunk, points = &pluginpb.Response{}, 0
+			}
+			chunk.Series = append(chunk.Series, seriesToProto(part))
+			points += len(part.Points)
+		}
+	}
+	chunk.Error = out.Error
+	return stream.Send(chunk)
+}
+
+// Shutdown implements pluginpb.PluginServer.
+func (g *grpcConnector) Shutdown(ctx context.Context, in *pluginpb.Empty) (*pluginpb.ShutdownReply, error) {
+	var ok bool
+	err := g.c.Shutdown(nil, &ok)
+	return &pluginpb.ShutdownReply{Ok: ok}, err
+}
+
+// ---------------------------------------------------------------------------------
+// Conversion
+// ---------------------------------------------------------------------------------
+
+// Proto returns the fingerprint as protobuf message.
+func (f *Fingerprint) Proto() *pluginpb.Fingerprint {
+	return &pluginpb.Fingerprint{
+		Name:         f.Name,
+		Port:         int32(f.Port),
+		Address:      f.Address,
+		Pid:          int32(f.Pid),
+		Token:        f.Token,
+		Protocol:     int32(f.Protocol),
+		Capabilities: f.Capabilities,
+	}
+}
+
+// FingerprintFromProto returns the fingerprint of the protobuf message.
+func FingerprintFromProto(f *pluginpb.Fingerprint) Fingerprint {
+	return Fingerprint{
+		Name:         f.GetName(),
+		Port:         int(f.GetPort()),
+		Address:      f.GetAddress(),
+		Pid:          int(f.GetPid()),
+		Token:        f.GetToken(),
+		Protocol:     int(f.GetProtocol()),
+		Capabilities: f.GetCapabilities(),
+	}
+}
+
+// Proto returns the description as protobuf message.
+func (d *Description) Proto() *pluginpb.Description {
+	out := &pluginpb.Description{
+		Description: d.Description,
+		Author:      d.Author,
+		Version:     d.Version,
+	}
+	for _, a := range d.Arguments {
+		out.Arguments = append(out.Arguments, &pluginpb.Argument{
+			Name:        a.Name,
+			Description: a.Description,
+			Default:     a.Default,
+			Optional:    a.Optional,
+		})
+	}
+	return out
+}
+
+// DescriptionFromProto returns the description of the protobuf message.
+func DescriptionFromProto(d *pluginpb.Description) *Description {
+	out := &Description{
+		Description: d.GetDescription(),
+		Author:      d.GetAuthor(),
+		Version:     d.GetVersion(),
+	}
+	for _, a := range d.GetArguments() {
+		out.Arguments = append(out.Arguments, Argument{
+			Name:        a.GetName(),
+			Description: a.GetDescription(),
+			Default:     a.GetDefault(),
+			Optional:    a.GetOptional(),
+		})
+	}
+	return out
+}
+
+// Proto returns the request as protobuf message.
+func (r *Request) Proto() *pluginpb.Request {
+	out := &pluginpb.Request{
+		Query: make(map[string]*pluginpb.Values, len(r.Query)),
+		Body:  r.Body,
+	}
+	for k, v := range r.Query {
+		out.Query[k] = &pluginpb.Values{Values: v}
+	}
+	if len(r.Header) > 0 {
+		out.Header = make(map[string]*pluginpb.Values, len(r.Header))
+		for k, v := range r.Header {
+			out.Header[k] = &pluginpb.Values{Values: v}
+		}
+	}
+	return out
+}
+
+// RequestFromProto returns the request of the protobuf message.
+func RequestFromProto(r *pluginpb.Request) Request {
+	out := Request{
+		Body: r.GetBody(),
+	}
+	if len(r.GetQuery()) > 0 {
+		out.Query = make(url.Values, len(r.GetQuery()))
+		for k, v := range r.GetQuery() {
+			out.Query[k] = v.GetValues()
+		}
+	}
+	if len(r.GetHeader()) > 0 {
+		out.Header = make(http.Header, len(r.GetHeader()))
+		for k, v := range r.GetHeader() {
+			out.Header[k] = v.GetValues()
+		}
+	}
+	return out
+}
+
+// Proto returns the response as protobuf message.
+func (r *Response) Proto() *pluginpb.Response {
+	out := &pluginpb.Response{
+		Error: r.Error,
+	}
+	for _, s := range r.Series {
+		out.Series = append(out.Series, seriesToProto(s))
+	}
+	return out
+}
+
+// AddProto adds the series and the error of the protobuf message to the response.
+// RunStream splits large series between messages, so a first series with the name and
+// the columns of the last series of the response continues it: its points are
+// appended, and the response looks like the one of the other codecs.
+func (r *Response) AddProto(m *pluginpb.Response) {
+	for i, s := range m.GetSeries() {
+		if i == 0 && len(r.Series) > 0 {
+			last := r.Series[len(r.Series)-1]
+			if last.Name == s.GetName() && equalColumns(last.Columns, s.GetColumns()) {
+				last.Points = append(last.Points, seriesFromProto(s).Points...)
+				continue
+			}
+		}
+		r.Series = append(r.Series, seriesFromProto(s))
+	}
+	if m.GetError() != "" {
+		r.Error = m.GetError()
+	}
+}
+
+// equalColumns reports whether both series have the same columns.
+func equalColumns(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// seriesToProto returns the series as protobuf message. Values of types without a
+// protobuf counterpart are sent as strings.
+func seriesToProto(s *influxdb.Series) *pluginpb.Series {
+	if s == nil {
+		return &pluginpb.Series{}
+	}
+	out := &pluginpb.Series{
+		Name:    s.Name,
+		Columns: s.Columns,
+		Points:  make([]*pluginpb.Point, len(s.Points)),
+	}
+	for i, p := range s.Points {
+		values := make([]*pluginpb.Value, len(p))
+		for j, v := range p {
+			values[j] = valueToProto(v)
+		}
+		out.Points[i] = &pluginpb.Point{Values: values}
+	}
+	return out
+}
+
+// seriesFromProto returns the series of the protobuf message.
+func seriesFromProto(s *pluginpb.Series) *influxdb.Series {
+	out := &influxdb.Series{
+		Name:    s.GetName(),
+		Columns: s.GetColumns(),
+		Points:  make([][]interface{}, len(s.GetPoints())),
+	}
+	for i, p := range s.GetPoints() {
+		values := make([]interface{}, len(p.GetValues()))
+		for j, v := range p.GetValues() {
+			values[j] = valueFromProto(v)
+		}
+		out.Points[i] = values
+	}
+	return out
+}
+
+// valueToProto returns a single value of a point as protobuf message.
+func valueToProto(v interface{}) *pluginpb.Value {
+	switch v := v.(type) {
+	case nil:
+		return &pluginpb.Value{}
+	case float64:
+		return &pluginpb.Value{Kind: &pluginpb.Value_DoubleValue{DoubleValue: v}}
+	case float32:
+		return &pluginpb.Value{Kind: &pluginpb.Value_DoubleValue{DoubleValue: float64(v)}}
+	case int:
+		return &pluginpb.Value{Kind: &pluginpb.Value_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &pluginpb.Value{Kind: &pluginpb.Value_IntValue{IntValue: v}}
+	case int32:
+		return &pluginpb.Value{Kind: &pluginpb.Value_IntValue{IntValue: int64(v)}}
+	case uint32:
+		return &pluginpb.Value{Kind: &pluginpb.Value_IntValue{IntValue: int64(v)}}
+	case string:
+		return &pluginpb.Value{Kind: &pluginpb.Value_StringValue{StringValue: v}}
+	case bool:
+		return &pluginpb.Value{Kind: &pluginpb.Value_BoolValue{BoolValue: v}}
+	default:
+		return &pluginpb.Value{Kind: &pluginpb.Value_StringValue{StringValue: fmt.Sprint(v)}}
+	}
+}
+
+// valueFromProto returns a single value of a point of the protobuf message.
+func valueFromProto(v *pluginpb.Value) interface{} {
+	switch k := v.GetKind().(type) {
+	case *pluginpb.Value_DoubleValue:
+		return k.DoubleValue
+	case *pluginpb.Value_IntValue:
+		return k.IntValue
+	case *pluginpb.Value_StringValue:
+		return k.StringValue
+	case *pluginpb.Value_BoolValue:
+		return k.BoolValue
+	default:
+		return nil
+	}
+}
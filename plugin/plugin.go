@@ -4,10 +4,12 @@
 // progam to be called as a plugin.
 //
 // For more insights of the concept, read the documentation of the orchestrator
-// (github.com/influxproxy/influxproxy/orchestrator).
+// (github.com/influxproxy/influxproxy/orchestrator). Plugins written in other
+// languages implement the protocol described in PROTOCOL.md instead.
 package plugin
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -17,6 +19,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"time"
+
+	"github.com/influxproxy/influxproxy/plugin/pluginpb"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -30,9 +35,12 @@ const (
 // Plugin is the core of the client side plugin infrastructure. It hold all information
 // and provides all functionality used by the cumtom plugin implementation itself.
 type Plugin struct {
-	Config      *PluginConfiguration
-	Fingerprint *Fingerprint
-	Client      *rpc.Client
+	Config       *PluginConfiguration
+	Fingerprint  *Fingerprint
+	Client       *rpc.Client
+	Capabilities []string                    // capabilities shared by the plugin and the orchestrator
+	orchClient   pluginpb.OrchestratorClient // client of the orchestrator with CodecGRPC
+	grpcConns    *ConnListener               // authenticated connections for the gRPC server
 }
 
 // NewPlugin reads the required configuration from the environment and returns an
@@ -41,24 +49,64 @@ func NewPlugin() (*Plugin, error) {
 	max, _ := strconv.Atoi(os.Getenv("PLUGIN_MAX_PORT"))
 	min, _ := strconv.Atoi(os.Getenv("PLUGIN_MIN_PORT"))
 	connString := os.Getenv("ORCHESTRATOR_CONN_STRING")
+	socket := os.Getenv("PLUGIN_SOCKET")
+	token := os.Getenv("PLUGIN_TOKEN")
+	orchToken := os.Getenv("ORCHESTRATOR_TOKEN")
+
+	// Orchestrators that do not know about transports always use TCP.
+	network := os.Getenv("ORCHESTRATOR_NETWORK")
+	if network == "" {
+		network = "tcp"
+	}
 
-	// The name of the plugin is the name of the binary. This allows
-	// to copy a binary or use symlinks to run the same plugin multiple times.
-	name := filepath.Base(os.Args[0])
+	// The orchestrator tells the plugin its name, so the same binary can run
+	// as several plugins. Older orchestrators name a plugin after its binary.
+	name := os.Getenv("PLUGIN_NAME")
+	if name == "" {
+		name = filepath.Base(os.Args[0])
+	}
 
-	if max != 0 && min != 0 && connString != "" {
+	// Orchestrators that do not state their protocol predate the negotiation; the
+	// plugin falls back to the protocol and capabilities they understand.
+	orchVersion, _ := strconv.Atoi(os.Getenv("ORCHESTRATOR_PROTOCOL"))
+	version, err := NegotiateProtocol(orchVersion)
+	if err != nil {
+		return nil, err
+	}
+	var orchCapabilities []string
+	if v, ok := os.LookupEnv("ORCHESTRATOR_CAPABILITIES"); ok {
+		orchCapabilities = ParseCapabilities(v)
+	}
+	var orchCodecs []string
+	if v, ok := os.LookupEnv("ORCHESTRATOR_CODECS"); ok {
+		orchCodecs = ParseCapabilities(v)
+	}
+
+	ports := max != 0 && min != 0
+	if connString != "" && (network == "tcp" && ports || network == "unix" && socket != "") {
 		conf := &PluginConfiguration{
 			OrchConnString: connString,
+			Network:        network,
+			Socket:         socket,
+			Token:          token,
+			OrchToken:      orchToken,
+			Codec:          CodecGob,
+			OrchCodecs:     orchCodecs,
 			MaxPort:        max,
 			MinPort:        min,
 		}
 		fp := &Fingerprint{
-			Name: name,
+			Name:         name,
+			Pid:          os.Getpid(),
+			Token:        token,
+			Protocol:     version,
+			Capabilities: Capabilities,
 		}
 
 		p := &Plugin{
-			Config:      conf,
-			Fingerprint: fp,
+			Config:       conf,
+			Fingerprint:  fp,
+			Capabilities: CommonCapabilities(orchCapabilities),
 		}
 		return p, nil
 	} else {
@@ -67,8 +115,14 @@ func NewPlugin() (*Plugin, error) {
 }
 
 // getListener allocates a port from an given range dynamically and returns a listener
-// if any port was available in this range.
+// if any port was available in this range. With the Unix transport, the listener is
+// bound to the socket given by the orchestrator.
 func (p *Plugin) getListener() (net.Listener, int, error) {
+	if p.Config.Network == "unix" {
+		listener, err := net.Listen("unix", p.Config.Socket)
+		return listener, 0, err
+	}
+
 	for port := p.Config.MinPort; port <= p.Config.MaxPort; port++ {
 		connection := fmt.Sprintf("%s:%d", localhost, port)
 		listener, err := net.Listen("tcp", connection)
@@ -81,12 +135,14 @@ func (p *Plugin) getListener() (net.Listener, int, error) {
 }
 
 // Run starts the plugin and keeps it runnung until the orchestrator cannot be
-// pinged anymore.
+// pinged anymore or asks the plugin to shut down.
 func (p *Plugin) Run(e Exposer) {
 	keepalive := make(chan bool)
-	c := make(chan int)
-	go p.launch(c, e)
-	p.Fingerprint.Port = <-c
+	c := make(chan error)
+	go p.launch(c, e, keepalive)
+	if err := <-c; err != nil {
+		log.Fatal(err)
+	}
 	p.handshake()
 	go func() {
 		for {
@@ -97,36 +153,72 @@ func (p *Plugin) Run(e Exposer) {
 	<-keepalive
 }
 
-// launch starts the RPC connection and keeps respondung to incoming requests
-func (p *Plugin) launch(c chan int, e Exposer) error {
+// launch starts the RPC connection and keeps respondung to incoming requests. As soon
+// as the plugin listens, its address is added to the fingerprint and c is unblocked.
+func (p *Plugin) launch(c chan error, e Exposer, quit chan bool) error {
+	if !SupportsCodec(p.Config.OrchCodecs, p.Config.Codec) {
+		err := errors.New("Orchestrator does not speak codec '" + p.Config.Codec + "'")
+		c <- err
+		return err
+	}
 	api, err := NewConnector(e)
 	if err != nil {
-		c <- 0
+		c <- err
 		return err
 	}
+	api.quit = quit
 	rpc.Register(api)
 	ln, port, err := p.getListener()
 
 	if err != nil {
-		c <- 0
+		c <- err
 		return err
 	}
-	c <- port
+	if p.Config.Codec == CodecGRPC {
+		p.grpcConns = NewConnListener(ln.Addr())
+		s := grpc.NewServer()
+		pluginpb.RegisterPluginServer(s, &grpcConnector{c: api})
+		go s.Serve(p.grpcConns)
+	}
+	p.Fingerprint.Port = port
+	p.Fingerprint.Address = ln.Addr().String()
+	c <- nil
 	for {
 		con, err := ln.Accept()
 		if err != nil {
 			continue
 		}
-		go rpc.ServeConn(con)
+		go p.serve(con)
 	}
-	return nil
+}
+
+// serve serves RPC requests on the given connection. If the orchestrator passed tokens,
+// only connections of the orchestrator that launched the plugin are served.
+func (p *Plugin) serve(con net.Conn) {
+	if p.Config.OrchToken != "" {
+		err := acceptAuthenticated(con, p.Config.Token, p.Config.OrchToken, p.Config.Codec)
+		if err != nil {
+			con.Close()
+			return
+		}
+	}
+	if p.grpcConns != nil {
+		p.grpcConns.Put(con)
+		return
+	}
+	ServeConn(p.Config.Codec, con)
 }
 
 // ping checks if the orchestrator is still rechable via its exposed Ping function
 func (p *Plugin) ping(c chan bool) {
-	var reply bool
-	call := new([]interface{})
-	err := p.Client.Call("Connector.Ping", *call, &reply)
+	var err error
+	if p.orchClient != nil {
+		_, err = p.orchClient.Ping(context.Background(), &pluginpb.Empty{})
+	} else {
+		var reply bool
+		call := new([]interface{})
+		err = p.Client.Call("Connector.Ping", *call, &reply)
+	}
 	if err != nil {
 		c <- true
 	}
@@ -135,12 +227,25 @@ func (p *Plugin) ping(c chan bool) {
 // handshake connects to the orchestrator and communicates the port that provides
 // the RPC interface that allows the orchestrator to communicate with the plugin.
 func (p *Plugin) handshake() bool {
-	client, err := rpc.Dial("tcp", p.Config.OrchConnString)
-	if err != nil {
-		log.Fatal(err)
+	if p.Config.Codec == CodecGRPC {
+		return p.handshakeGRPC()
+	}
+	var client *rpc.Client
+	if p.Config.OrchToken != "" {
+		con, err := DialAuthenticated(p.Config.Network, p.Config.OrchConnString, p.Config.Token, p.Config.OrchToken, p.Config.Codec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client = NewClient(p.Config.Codec, con)
+	} else {
+		c, err := rpc.Dial(p.Config.Network, p.Config.OrchConnString)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client = c
 	}
 	var reply bool
-	err = client.Call("Connector.Handshake", p.Fingerprint, &reply)
+	err := client.Call("Connector.Handshake", p.Fingerprint, &reply)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -148,6 +253,21 @@ func (p *Plugin) handshake() bool {
 	return reply
 }
 
+// handshakeGRPC is handshake for CodecGRPC.
+func (p *Plugin) handshakeGRPC() bool {
+	conn, err := DialGRPC(p.Config.Network, p.Config.OrchConnString, p.Config.Token, p.Config.OrchToken)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := pluginpb.NewOrchestratorClient(conn)
+	reply, err := client.Handshake(context.Background(), p.Fingerprint.Proto())
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.orchClient = client
+	return reply.GetOk()
+}
+
 // ---------------------------------------------------------------------------------
 // Fingerprint
 // ---------------------------------------------------------------------------------
@@ -155,8 +275,13 @@ func (p *Plugin) handshake() bool {
 // Fingerprint provides all infromation to identify a plugin and perform an handshake
 // with the orchestrator program
 type Fingerprint struct {
-	Name string
-	Port int
+	Name         string
+	Port         int
+	Address      string   // address (host:port or socket path) of the RPC server of the plugin
+	Pid          int      // allows the orchestrator to tell several processes of the same plugin apart
+	Token        string   // proves that the plugin was launched by the orchestrator
+	Protocol     int      // protocol version the plugin speaks with the orchestrator
+	Capabilities []string // capabilities implemented by the plugin
 }
 
 // ---------------------------------------------------------------------------------
@@ -167,6 +292,12 @@ type Fingerprint struct {
 // via environment variables at launch time.
 type PluginConfiguration struct {
 	OrchConnString string
+	Network        string   // "tcp" or "unix"
+	Socket         string   // path of the Unix domain socket of the plugin
+	Token          string   // token the plugin presents to the orchestrator
+	OrchToken      string   // token the orchestrator presents to the plugin
+	Codec          string   // codec the plugin speaks, may be set to CodecJSON or CodecGRPC before Run
+	OrchCodecs     []string // codecs the orchestrator speaks
 	MaxPort        int
 	MinPort        int
 }
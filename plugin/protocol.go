@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the version of the protocol between the orchestrator and its
+// plugins implemented by this package. It is increased whenever Request, Response or
+// the RPC methods change incompatibly.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest protocol version this package still speaks.
+const MinProtocolVersion = 1
+
+// Capabilities are optional features of the protocol. Orchestrator and plugin only
+// make use of a capability if both of them support it.
+const (
+	CapabilityHealth   = "health"   // Connector.Ping can be used for health checks
+	CapabilityShutdown = "shutdown" // Connector.Shutdown asks the plugin to exit
+	CapabilityStream   = "stream"   // Plugin.RunStream splits large outputs, only with CodecGRPC
+)
+
+// Capabilities lists the capabilities implemented by this package.
+var Capabilities = []string{CapabilityHealth, CapabilityShutdown, CapabilityStream}
+
+// LegacyCapabilities are the capabilities of peers that predate the negotiation of the
+// protocol.
+var LegacyCapabilities = []string{CapabilityHealth}
+
+// ---------------------------------------------------------------------------------
+// Negotiation
+// ---------------------------------------------------------------------------------
+
+// NegotiateProtocol returns the protocol version to speak with a peer that speaks up
+// to the given version. Peers that did not state a version (0) predate the
+// negotiation and speak version 1.
+func NegotiateProtocol(peer int) (int, error) {
+	if peer == 0 {
+		peer = 1
+	}
+	version := ProtocolVersion
+	if peer < version {
+		version = peer
+	}
+	if version < MinProtocolVersion {
+		return 0, errors.New("Incompatible protocol: peer speaks version " + strconv.Itoa(peer) +
+			", at least version " + strconv.Itoa(MinProtocolVersion) + " is required")
+	}
+	return version, nil
+}
+
+// CheckProtocol checks that the given version, chosen by the peer, is supported.
+func CheckProtocol(version int) error {
+	if version == 0 {
+		version = 1
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return errors.New("Incompatible protocol: peer speaks version " + strconv.Itoa(version) +
+			", supported are versions " + strconv.Itoa(MinProtocolVersion) + " to " + strconv.Itoa(ProtocolVersion))
+	}
+	return nil
+}
+
+// CommonCapabilities returns the capabilities the peer shares with this package. Peers
+// that did not state their capabilities (nil) get the LegacyCapabilities.
+func CommonCapabilities(peer []string) []string {
+	if peer == nil {
+		peer = LegacyCapabilities
+	}
+	var out []string
+	for _, c := range Capabilities {
+		if HasCapability(peer, c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// HasCapability reports whether the capability is in the list.
+func HasCapability(capabilities []string, c string) bool {
+	for _, e := range capabilities {
+		if e == c {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatCapabilities formats a list of capabilities for an environment variable.
+func FormatCapabilities(capabilities []string) string {
+	return strings.Join(capabilities, ",")
+}
+
+// ParseCapabilities parses a list of capabilities from an environment variable.
+func ParseCapabilities(s string) []string {
+	out := []string{}
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
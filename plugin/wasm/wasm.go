@@ -0,0 +1,81 @@
+//go:build wasip1
+
+// Package wasm turns a plugin into a WebAssembly module that influxproxy runs
+// in-process (plugin kind "wasm"). The module exports the functions described in
+// PROTOCOL.md and hands the calls to the exposer of the plugin:
+//
+//	func init() {
+//		wasm.Expose(&MyPlugin{})
+//	}
+//
+//	func main() {}
+//
+// Build the module as WASI reactor, so its functions can be called after the
+// initialization:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o myplugin.wasm
+package wasm
+
+import (
+	"encoding/json"
+	"unsafe"
+
+	"github.com/influxproxy/influxproxy/plugin"
+)
+
+// exposer serves the calls of the module.
+var exposer plugin.Exposer
+
+// buffers keeps the memory handed out by alloc and the latest output alive. The
+// orchestrator runs a single call per instance, so nothing is ever freed.
+var buffers [][]byte
+
+// Expose registers the exposer of the plugin. It needs to be called during the
+// initialization of the module, i.e. from an init function.
+func Expose(e plugin.Exposer) {
+	exposer = e
+}
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	buf := make([]byte, size)
+	buffers = append(buffers, buf)
+	return address(buf)
+}
+
+//go:wasmexport run
+func run(ptr uint32, size uint32) uint64 {
+	in := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(ptr))), size)
+	var data plugin.Request
+	var reply plugin.Response
+	err := json.Unmarshal(in, &data)
+	if err != nil {
+		reply = plugin.Response{Error: "Invalid request: " + err.Error()}
+	} else {
+		reply = exposer.Run(data)
+	}
+	return output(reply)
+}
+
+//go:wasmexport describe
+func describe() uint64 {
+	return output(exposer.Describe())
+}
+
+// output encodes v as JSON and returns its address and size for the orchestrator.
+func output(v interface{}) uint64 {
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(plugin.Response{Error: err.Error()})
+	}
+	buffers = append(buffers, out)
+	return uint64(address(out))<<32 | uint64(len(out))
+}
+
+// address returns the address of the first byte of buf in the linear memory.
+func address(buf []byte) uint32 {
+	if len(buf) == 0 {
+		return 0
+	}
+	return uint32(uintptr(unsafe.Pointer(&buf[0])))
+}